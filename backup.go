@@ -0,0 +1,147 @@
+package hexaboltdb
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errDBExists = errors.New("database file exists")
+)
+
+// Backup writes a consistent snapshot of the whole database to the writer
+// while it remains open for reads and writes.  It returns the number of bytes
+// written.
+func (db *DB) Backup(w io.Writer) (int64, error) {
+	db.cmu.RLock()
+	defer db.cmu.RUnlock()
+
+	var n int64
+	err := db.View(func(tx *bolt.Tx) (er error) {
+		n, er = tx.WriteTo(w)
+		return
+	})
+	return n, err
+}
+
+// RestoreDB validates the snapshot read from r and installs it as the shared
+// database file in the data directory.  The file must not already exist.  Only
+// the filename and file mode options apply.
+func RestoreDB(r io.Reader, datadir string, opts ...Option) error {
+	conf := newConfig("hexa.db", "", opts)
+	return restoreDB(r, datadir, conf)
+}
+
+// Backup writes a consistent snapshot of the database to the writer.  For a
+// shared database the snapshot contains the data of all stores.
+func (store *EntryStore) Backup(w io.Writer) (int64, error) {
+	return store.db.Backup(w)
+}
+
+// Restore validates the snapshot read from r and installs it as the store's
+// database file in the data directory.  The file must not already exist.  The
+// store must be opened after a successful restore.
+func (store *EntryStore) Restore(r io.Reader, datadir string) error {
+	return restoreDB(r, datadir, store.conf, store.bucket)
+}
+
+// Backup flushes all open KeylogIndexes then writes a consistent snapshot of
+// the database to the writer.  Changes made after the flush are captured by
+// the journal contained in the snapshot.
+func (store *IndexStore) Backup(w io.Writer) (int64, error) {
+	if err := store.openIdxs.flushAll(); err != nil {
+		return 0, err
+	}
+	return store.db.Backup(w)
+}
+
+// Restore validates the snapshot read from r and installs it as the store's
+// database file in the data directory.  The file must not already exist.  The
+// store must be opened after a successful restore.
+func (store *IndexStore) Restore(r io.Reader, datadir string) error {
+	return restoreDB(r, datadir, store.conf, store.bucket)
+}
+
+// Backup writes a consistent snapshot of the database to the writer.  For a
+// shared database the snapshot contains the data of all stores.
+func (index *BlockIndex) Backup(w io.Writer) (int64, error) {
+	return index.db.Backup(w)
+}
+
+// Restore validates the snapshot read from r and installs it as the index's
+// database file in the data directory.  The file must not already exist.  The
+// index must be opened after a successful restore.
+func (index *BlockIndex) Restore(r io.Reader, datadir string) error {
+	return restoreDB(r, datadir, index.conf, index.bucket)
+}
+
+// restoreDB writes the snapshot to a temporary file in the data directory,
+// validates it and renames it to the configured filename.
+func restoreDB(r io.Reader, datadir string, conf *config, buckets ...[]byte) error {
+	filename := filepath.Join(datadir, conf.filename)
+	if _, err := os.Stat(filename); err == nil {
+		return errDBExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(datadir, conf.filename+".restore-")
+	if err != nil {
+		return err
+	}
+	tmpname := tmp.Name()
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if er := tmp.Close(); err == nil {
+		err = er
+	}
+	if err == nil {
+		err = os.Chmod(tmpname, conf.mode)
+	}
+	if err == nil {
+		err = validateDB(tmpname, conf, buckets...)
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// validateDB opens the database file read-only and checks its consistency and
+// that the required buckets exist
+func validateDB(filename string, conf *config, buckets ...[]byte) error {
+	db, err := bolt.Open(filename, conf.mode, &bolt.Options{ReadOnly: true, Timeout: conf.boltOpt.Timeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if tx.Bucket(b) == nil {
+				return bolt.ErrBucketNotFound
+			}
+		}
+
+		// Drain all errors so the checker is done before the tx is closed
+		var err error
+		for er := range tx.Check() {
+			if err == nil {
+				err = er
+			}
+		}
+		return err
+	})
+}
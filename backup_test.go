@@ -0,0 +1,70 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/hexalog"
+)
+
+func Test_IndexStore_Backup(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent := &hexalog.Entry{Previous: make([]byte, 32), Key: []byte("key")}
+	id := ent.Hash(sha256.New())
+	if err = ki.Append(id, ent.Previous, 1); err != nil {
+		t.Fatal(err)
+	}
+	ki.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err = idxs.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	// Target file exists
+	if err = idxs.Restore(bytes.NewReader(snapshot), tmpdir); err != errDBExists {
+		t.Fatalf("should fail with='%v' got='%v'", errDBExists, err)
+	}
+
+	// Invalid snapshot
+	restoredir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(restoredir)
+
+	idxs1 := NewIndexStore()
+	if err = idxs1.Restore(bytes.NewReader([]byte("garbage")), restoredir); err == nil {
+		t.Fatal("should fail to restore invalid snapshot")
+	}
+
+	if err = idxs1.Restore(bytes.NewReader(snapshot), restoredir); err != nil {
+		t.Fatal(err)
+	}
+	if err = idxs1.Open(restoredir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs1.Close()
+
+	ki, err = idxs1.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+	if !bytes.Equal(ki.Last(), id) {
+		t.Fatal("last id mismatch")
+	}
+}
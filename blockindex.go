@@ -1,9 +1,10 @@
 package hexaboltdb
 
 import (
+	"encoding/binary"
+	"errors"
 	"log"
-	"os"
-	"path/filepath"
+	"sync"
 
 	"github.com/boltdb/bolt"
 	"github.com/hexablock/blox/block"
@@ -12,20 +13,37 @@ import (
 
 // IN-PROGRESS
 
+var errInvalidStats = errors.New("invalid block index stats")
+
+// Key of the stats value in the stats bucket
+var blockStatsKey = []byte("stats")
+
 // BlockIndex is a boltdb based index of all blocks on a device
 type BlockIndex struct {
-	opt    *bolt.Options
+	conf   *config
 	bucket []byte
-	mode   os.FileMode
-	db     *bolt.DB
+	// Boltdb bucket holding the stats as of the last write
+	sbucket []byte
+	db      *DB
+	// Whether the db is shared and owned by the caller
+	shared bool
+
+	// Stats kept up to date by Set and Remove.  They are stored along with
+	// each change and loaded on open
+	smu   sync.Mutex
+	stats device.Stats
 }
 
-// NewBlockIndex inits a new boltdb backed entry store with defaults
-func NewBlockIndex() *BlockIndex {
+// NewBlockIndex inits a new boltdb backed block index.  Options not given use
+// their defaults.  The default filename is index.db, the same as the
+// IndexStore, so opening both in one data directory requires a shared DB or a
+// different filename
+func NewBlockIndex(opts ...Option) *BlockIndex {
+	conf := newConfig("index.db", "blocks", opts)
 	return &BlockIndex{
-		opt:    bolt.DefaultOptions,
-		bucket: []byte("blocks"),
-		mode:   0755,
+		conf:    conf,
+		bucket:  conf.bucket,
+		sbucket: append(append([]byte{}, conf.bucket...), ".stats"...),
 	}
 }
 
@@ -36,14 +54,22 @@ func (index *BlockIndex) Name() string {
 
 // Open opens the rocks store for writing
 func (index *BlockIndex) Open(datadir string) error {
-	filename := filepath.Join(datadir, "index.db")
-	db, err := bolt.Open(filename, index.mode, index.opt)
+	db, err := openDB(datadir, index.conf, index.bucket, index.sbucket)
 	if err == nil {
 		index.db = db
-		err = db.Update(func(tx *bolt.Tx) error {
-			_, er := tx.CreateBucketIfNotExists(index.bucket)
-			return er
-		})
+		err = index.loadStats()
+	}
+	return err
+}
+
+// OpenDB opens the index using a shared database.  Closing the index does not
+// close the shared database.
+func (index *BlockIndex) OpenDB(db *DB) error {
+	err := db.createBuckets(index.bucket, index.sbucket)
+	if err == nil {
+		index.db = db
+		index.shared = true
+		err = index.loadStats()
 	}
 	return err
 }
@@ -92,16 +118,105 @@ func (index *BlockIndex) Iter(cb func(*device.IndexEntry) error) error {
 	})
 }
 
-// Set an block index entry to the index store
+// Set an block index entry to the index store.  Concurrent calls are
+// coalesced into a single transaction
 func (index *BlockIndex) Set(idx *device.IndexEntry) error {
-	return index.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(index.bucket)
-		value, err := idx.MarshalBinary()
-		if err == nil {
-			err = bkt.Put(idx.ID(), value)
-		}
+	value, err := idx.MarshalBinary()
+	if err != nil {
 		return err
+	}
+
+	var prev *device.IndexEntry
+	err = index.db.Batch(func(tx *bolt.Tx) (er error) {
+		// Batch may call this more than once
+		if prev, er = index.put(tx, idx.ID(), value); er != nil {
+			return er
+		}
+		return index.writeStats(tx, func(stats *device.Stats) {
+			if prev != nil {
+				addBlockStats(stats, prev, false)
+			}
+			addBlockStats(stats, idx, true)
+		})
+	})
+
+	if err == nil {
+		index.smu.Lock()
+		if prev != nil {
+			index.updateStats(prev, false)
+		}
+		index.updateStats(idx, true)
+		index.smu.Unlock()
+	}
+
+	return err
+}
+
+// SetBatch sets multiple block index entries in a single transaction.  It
+// returns an error per entry in the order given where a nil error means the
+// entry was written.  A non-nil second return value means the transaction
+// failed and nothing was written.
+func (index *BlockIndex) SetBatch(idxs []*device.IndexEntry) ([]error, error) {
+	errs := make([]error, len(idxs))
+	values := make([][]byte, len(idxs))
+	for i, idx := range idxs {
+		values[i], errs[i] = idx.MarshalBinary()
+	}
+
+	prevs := make([]*device.IndexEntry, len(idxs))
+	err := index.db.Update(func(tx *bolt.Tx) error {
+		for i, idx := range idxs {
+			if errs[i] == nil {
+				prevs[i], errs[i] = index.put(tx, idx.ID(), values[i])
+			}
+		}
+		return index.writeStats(tx, func(stats *device.Stats) {
+			for i, idx := range idxs {
+				if errs[i] != nil {
+					continue
+				}
+				if prevs[i] != nil {
+					addBlockStats(stats, prevs[i], false)
+				}
+				addBlockStats(stats, idx, true)
+			}
+		})
 	})
+
+	if err != nil {
+		return errs, err
+	}
+
+	index.smu.Lock()
+	for i, idx := range idxs {
+		if errs[i] != nil {
+			continue
+		}
+		if prevs[i] != nil {
+			index.updateStats(prevs[i], false)
+		}
+		index.updateStats(idx, true)
+	}
+	index.smu.Unlock()
+
+	return errs, nil
+}
+
+// put writes the marshalled entry returning the existing entry it replaced if
+// any so it can be removed from the stats
+func (index *BlockIndex) put(tx *bolt.Tx, id, value []byte) (*device.IndexEntry, error) {
+	var prev *device.IndexEntry
+
+	bkt := tx.Bucket(index.bucket)
+	if val := bkt.Get(id); val != nil {
+		var p device.IndexEntry
+		if err := p.UnmarshalBinary(val); err == nil {
+			prev = &p
+		}
+	}
+
+	index.db.track(tx, index.bucket, id)
+	return prev, bkt.Put(id, value)
 }
 
 func (index *BlockIndex) Remove(id []byte) (*device.IndexEntry, error) {
@@ -112,23 +227,147 @@ func (index *BlockIndex) Remove(id []byte) (*device.IndexEntry, error) {
 		if val == nil {
 			return block.ErrBlockNotFound
 		}
-		err := bkt.Delete(id)
-		if err == nil {
-			err = idx.UnmarshalBinary(val)
+		// Unmarshal before deleting as the value is invalid after the delete
+		if err := idx.UnmarshalBinary(val); err != nil {
+			return err
 		}
-		return err
+		index.db.track(tx, index.bucket, id)
+		if err := bkt.Delete(id); err != nil {
+			return err
+		}
+		return index.writeStats(tx, func(stats *device.Stats) {
+			addBlockStats(stats, &idx, false)
+		})
 	})
+
+	if err == nil {
+		index.smu.Lock()
+		index.updateStats(&idx, false)
+		index.smu.Unlock()
+	}
+
 	return &idx, err
 }
 
-// Stats returns statistics.  Also contains raw device stats
+// Stats returns statistics.  They are maintained as blocks are set and removed
+// and do not require scanning the index.  Also contains raw device stats
 func (index *BlockIndex) Stats() *device.Stats {
-	stats := &device.Stats{}
+	index.smu.Lock()
+	stats := index.stats
+	index.smu.Unlock()
 
-	return stats
+	return &stats
 }
 
-// Close closes the bolt store after which it can no longer be used.
+// loadStats loads the stored stats when the index is opened.  Indexes written
+// before stats were stored are scanned once and their stats stored.
+func (index *BlockIndex) loadStats() error {
+	index.smu.Lock()
+	defer index.smu.Unlock()
+
+	var ok bool
+	err := index.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(index.sbucket).Get(blockStatsKey)
+		if value == nil {
+			return nil
+		}
+		ok = true
+		return unmarshalBlockStats(value, &index.stats)
+	})
+	if err != nil || ok {
+		return err
+	}
+
+	index.stats = device.Stats{}
+	err = index.Iter(func(idx *device.IndexEntry) error {
+		addBlockStats(&index.stats, idx, true)
+		return nil
+	})
+	if err != nil || index.db.ReadOnly() {
+		return err
+	}
+
+	// Set and Remove are not called before the index is open so the scanned
+	// stats are current
+	return index.db.Update(func(tx *bolt.Tx) error {
+		return index.writeStats(tx, func(stats *device.Stats) {
+			*stats = index.stats
+		})
+	})
+}
+
+// writeStats applies fn to the stored stats within the transaction
+func (index *BlockIndex) writeStats(tx *bolt.Tx, fn func(*device.Stats)) error {
+	bkt := tx.Bucket(index.sbucket)
+
+	var stats device.Stats
+	if value := bkt.Get(blockStatsKey); value != nil {
+		if err := unmarshalBlockStats(value, &stats); err != nil {
+			return err
+		}
+	}
+	fn(&stats)
+
+	index.db.track(tx, index.sbucket, blockStatsKey)
+	return bkt.Put(blockStatsKey, marshalBlockStats(&stats))
+}
+
+// updateStats adds or subtracts the index entry from the stats.  The caller
+// must hold the stats lock
+func (index *BlockIndex) updateStats(idx *device.IndexEntry, add bool) {
+	addBlockStats(&index.stats, idx, add)
+}
+
+// addBlockStats adds or subtracts the index entry from the stats
+func addBlockStats(stats *device.Stats, idx *device.IndexEntry, add bool) {
+	n := 1
+	if add {
+		stats.UsedBytes += idx.Size()
+	} else {
+		n = -1
+		stats.UsedBytes -= idx.Size()
+	}
+
+	stats.TotalBlocks += n
+	switch idx.Type() {
+	case block.BlockTypeData:
+		stats.DataBlocks += n
+	case block.BlockTypeIndex:
+		stats.IndexBlocks += n
+	case block.BlockTypeTree:
+		stats.TreeBlocks += n
+	case block.BlockTypeMeta:
+		stats.MetaBlocks += n
+	}
+}
+
+// marshalBlockStats encodes the stats as the big endian block counts followed
+// by the used bytes
+func marshalBlockStats(stats *device.Stats) []byte {
+	buf := make([]byte, 48)
+	for i, n := range []int{stats.TotalBlocks, stats.DataBlocks, stats.IndexBlocks, stats.TreeBlocks, stats.MetaBlocks} {
+		binary.BigEndian.PutUint64(buf[i*8:], uint64(n))
+	}
+	binary.BigEndian.PutUint64(buf[40:], stats.UsedBytes)
+	return buf
+}
+
+func unmarshalBlockStats(b []byte, stats *device.Stats) error {
+	if len(b) != 48 {
+		return errInvalidStats
+	}
+	for i, n := range []*int{&stats.TotalBlocks, &stats.DataBlocks, &stats.IndexBlocks, &stats.TreeBlocks, &stats.MetaBlocks} {
+		*n = int(binary.BigEndian.Uint64(b[i*8:]))
+	}
+	stats.UsedBytes = binary.BigEndian.Uint64(b[40:])
+	return nil
+}
+
+// Close closes the bolt store after which it can no longer be used.  A shared
+// database is left open.
 func (index *BlockIndex) Close() error {
+	if index.shared {
+		return nil
+	}
 	return index.db.Close()
 }
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/boltdb/bolt"
 	"github.com/hexablock/blox"
 	"github.com/hexablock/blox/device"
 )
@@ -43,6 +44,43 @@ func Test_BlockIndex(t *testing.T) {
 	if index.BlockCount() == 0 {
 		t.Fatal("should have blocks")
 	}
+
+	stats := idx.Stats()
+	if stats.TotalBlocks == 0 || stats.UsedBytes == 0 {
+		t.Fatalf("stats not updated: %+v", stats)
+	}
+	if stats.TotalBlocks != stats.DataBlocks+stats.IndexBlocks+stats.TreeBlocks+stats.MetaBlocks {
+		t.Fatalf("type breakdown mismatch: %+v", stats)
+	}
+
+	// Stats stored along with each change should match the incrementally
+	// maintained ones
+	if err = idx.loadStats(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := idx.Stats(); loaded.TotalBlocks != stats.TotalBlocks || loaded.UsedBytes != stats.UsedBytes {
+		t.Fatalf("stats mismatch %+v != %+v", loaded, stats)
+	}
+
+	// Stats missing from older versions are computed and stored
+	err = idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(idx.sbucket).Delete(blockStatsKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.loadStats(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := idx.Stats(); loaded.TotalBlocks != stats.TotalBlocks || loaded.UsedBytes != stats.UsedBytes {
+		t.Fatalf("stats mismatch %+v != %+v", loaded, stats)
+	}
+	idx.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(idx.sbucket).Get(blockStatsKey) == nil {
+			t.Error("computed stats should be stored")
+		}
+		return nil
+	})
 	// wr, _ := ioutil.TempFile("/tmp", "blk-idx-")
 	// defer os.Remove(wr.Name())
 	// defer wr.Close()
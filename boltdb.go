@@ -1,3 +1,178 @@
 package hexaboltdb
 
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
 const dbname = "boltdb"
+
+// DB is a bolt database.  A single DB can be shared by the EntryStore,
+// IndexStore and BlockIndex of a data directory with each store keeping its
+// data in its own bucket.
+type DB struct {
+	conf *config
+	path string
+
+	// Held by writers and exclusively by compaction while it copies the last
+	// keys written during the copy and swaps files
+	wmu sync.RWMutex
+	// Held by backups and exclusively by compaction and closing.  Backups
+	// stream the file at the database path so it cannot be swapped meanwhile
+	cmu sync.RWMutex
+	// Protects the current file.  Only held to reference or swap the file and
+	// never while a transaction runs so transactions can be nested
+	mu  sync.Mutex
+	cur *boltFile
+	// Keys committed by writers since compaction last copied them.  nil unless
+	// compaction is running.  Protected by tmu
+	tmu    sync.Mutex
+	writes writeSet
+}
+
+// boltFile is an open bolt database and the transactions using it.  A file
+// swapped out by compaction is closed once they are done.
+type boltFile struct {
+	db *bolt.DB
+	wg sync.WaitGroup
+}
+
+// close waits for the transactions using the file and closes it
+func (f *boltFile) close() error {
+	f.wg.Wait()
+	return f.db.Close()
+}
+
+// OpenDB opens the bolt database in the data directory to be shared by multiple
+// stores.  The default filename is hexa.db.  Bucket and flush options are
+// ignored as they apply to the individual stores.
+func OpenDB(datadir string, opts ...Option) (*DB, error) {
+	conf := newConfig("hexa.db", "", opts)
+	return openDB(datadir, conf)
+}
+
+// openDB opens the configured bolt database in the data directory creating
+// the given buckets if they do not exist.
+func openDB(datadir string, conf *config, buckets ...[]byte) (*DB, error) {
+	path := filepath.Join(datadir, conf.filename)
+	bdb, err := openBolt(path, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{conf: conf, path: path, cur: &boltFile{db: bdb}}
+	if err = db.createBuckets(buckets...); err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openBolt opens the bolt file applying the configured options
+func openBolt(filename string, conf *config) (*bolt.DB, error) {
+	bdb, err := bolt.Open(filename, conf.mode, &conf.boltOpt)
+	if err != nil {
+		return nil, err
+	}
+
+	bdb.NoSync = conf.noSync
+	if conf.maxBatchSize > 0 {
+		bdb.MaxBatchSize = conf.maxBatchSize
+	}
+	if conf.maxBatchDelay > 0 {
+		bdb.MaxBatchDelay = conf.maxBatchDelay
+	}
+	return bdb, nil
+}
+
+// createBuckets creates the given buckets if they do not exist.  In read-only
+// mode the buckets must already exist.
+func (db *DB) createBuckets(buckets ...[]byte) error {
+	if db.conf.boltOpt.ReadOnly {
+		return db.View(func(tx *bolt.Tx) error {
+			for _, b := range buckets {
+				if tx.Bucket(b) == nil {
+					return bolt.ErrBucketNotFound
+				}
+			}
+			return nil
+		})
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if tx.Bucket(b) != nil {
+				continue
+			}
+			if _, er := tx.CreateBucket(b); er != nil {
+				return er
+			}
+			db.trackAll(tx, b)
+		}
+		return nil
+	})
+}
+
+// ReadOnly returns true if the database was opened in read-only mode
+func (db *DB) ReadOnly() bool {
+	return db.conf.boltOpt.ReadOnly
+}
+
+// acquire references the current file.  The caller must call Done on the
+// returned file's wait group once its transaction is done
+func (db *DB) acquire() *boltFile {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.cur.wg.Add(1)
+	return db.cur
+}
+
+// View executes the function within a read-only transaction
+func (db *DB) View(fn func(*bolt.Tx) error) error {
+	f := db.acquire()
+	defer f.wg.Done()
+	return f.db.View(fn)
+}
+
+// Update executes the function within a read-write transaction.  The function
+// must track the keys it changes so a running compaction copies them
+func (db *DB) Update(fn func(*bolt.Tx) error) error {
+	db.wmu.RLock()
+	defer db.wmu.RUnlock()
+	f := db.acquire()
+	defer f.wg.Done()
+	return f.db.Update(fn)
+}
+
+// Batch executes the function within a read-write transaction shared with
+// other concurrent Batch callers.  The function may be called more than once
+// and must be idempotent.  Like with Update it must track the keys it changes.
+func (db *DB) Batch(fn func(*bolt.Tx) error) error {
+	db.wmu.RLock()
+	defer db.wmu.RUnlock()
+	f := db.acquire()
+	defer f.wg.Done()
+	return f.db.Batch(fn)
+}
+
+// Sync forces an fsync of the database file.  It is only needed when the
+// database was opened with NoSync as commits are otherwise synced.
+func (db *DB) Sync() error {
+	f := db.acquire()
+	defer f.wg.Done()
+	return f.db.Sync()
+}
+
+// Close closes the underlying bolt database once in-flight transactions are
+// done.  Stores using the DB must not be used after it is closed.
+func (db *DB) Close() error {
+	db.cmu.Lock()
+	defer db.cmu.Unlock()
+
+	db.mu.Lock()
+	f := db.cur
+	db.mu.Unlock()
+	return f.close()
+}
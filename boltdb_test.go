@@ -0,0 +1,97 @@
+package hexaboltdb
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hexablock/hexalog"
+)
+
+func Test_DB_shared(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := OpenDB(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entries := NewEntryStore()
+	if err = entries.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	idxs := NewIndexStore()
+	if err = idxs.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	blocks := NewBlockIndex()
+	if err = blocks.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	ent := &hexalog.Entry{
+		Previous:  make([]byte, 32),
+		Key:       []byte("key"),
+		Timestamp: uint64(time.Now().UnixNano()),
+	}
+	id := ent.Hash(sha256.New())
+	if err = entries.Set(id, ent); err != nil {
+		t.Fatal(err)
+	}
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ki.Append(id, ent.Previous, 1); err != nil {
+		t.Fatal(err)
+	}
+	ki.Close()
+
+	if err = blocks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = idxs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = entries.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shared db should still be open after closing the stores
+	entries = NewEntryStore()
+	if err = entries.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = entries.Get(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_IndexStore_BlockIndex_samedir(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithTimeout(time.Second))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	// Both default to index.db which is locked by the IndexStore
+	blocks := NewBlockIndex(WithTimeout(100 * time.Millisecond))
+	if err := blocks.Open(tmpdir); err == nil {
+		blocks.Close()
+		t.Fatal("should fail to lock the IndexStore file")
+	}
+
+	blocks = NewBlockIndex(WithTimeout(time.Second), WithFilename("blocks.db"))
+	if err := blocks.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	blocks.Close()
+}
@@ -0,0 +1,467 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/hexablock/log"
+)
+
+var (
+	errReadOnly = errors.New("database is read-only")
+)
+
+const (
+	// Maximum size of data copied per transaction during compaction
+	compactTxMaxSize = 64 << 20
+	// Maximum number of times the keys written during compaction are copied
+	// before writers are paused to copy the rest
+	compactRounds = 3
+)
+
+// writeSet holds the keys written to each top level bucket.  A bucket mapped to
+// nil has been written in full
+type writeSet map[string]map[string]bool
+
+func (ws writeSet) add(bucket string, key []byte) {
+	keys, ok := ws[bucket]
+	if ok && keys == nil {
+		return
+	}
+	if key == nil {
+		ws[bucket] = nil
+		return
+	}
+	if keys == nil {
+		keys = make(map[string]bool)
+		ws[bucket] = keys
+	}
+	keys[string(key)] = true
+}
+
+// track records the key of the top level bucket as written once the
+// transaction commits so a running compaction copies it again.  Writers call
+// it for every key they change, the key being the nested bucket for changes
+// within one.
+func (db *DB) track(tx *bolt.Tx, bucket, key []byte) {
+	b, k := string(bucket), append([]byte{}, key...)
+	tx.OnCommit(func() {
+		db.tmu.Lock()
+		if db.writes != nil {
+			db.writes.add(b, k)
+		}
+		db.tmu.Unlock()
+	})
+}
+
+// trackAll records the whole top level bucket as written once the transaction
+// commits.  It is meant for bulk changes such as upgrades.
+func (db *DB) trackAll(tx *bolt.Tx, bucket []byte) {
+	b := string(bucket)
+	tx.OnCommit(func() {
+		db.tmu.Lock()
+		if db.writes != nil {
+			db.writes.add(b, nil)
+		}
+		db.tmu.Unlock()
+	})
+}
+
+// swapWrites returns the keys written since the last swap and records further
+// writes to ws.  A nil ws stops recording
+func (db *DB) swapWrites(ws writeSet) writeSet {
+	db.tmu.Lock()
+	defer db.tmu.Unlock()
+
+	prev := db.writes
+	db.writes = ws
+	return prev
+}
+
+// Compact copies all buckets into a fresh file and swaps it in place of the
+// current file reclaiming free pages.  Data is copied from a read transaction
+// while writers keep running.  Keys written in the meantime are copied again
+// a few times over after which writers are paused only to copy the keys
+// written since and swap the files.  Readers are never paused as the old file
+// stays open until the transactions using it are done.  It returns the number
+// of bytes reclaimed.
+func (db *DB) Compact() (int64, error) {
+	if db.ReadOnly() {
+		return 0, errReadOnly
+	}
+
+	db.cmu.Lock()
+	defer db.cmu.Unlock()
+
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	tmpname := db.path + ".compact"
+	os.Remove(tmpname)
+
+	dst, err := bolt.Open(tmpname, db.conf.mode, &bolt.Options{Timeout: db.conf.boltOpt.Timeout})
+	if err != nil {
+		return 0, err
+	}
+
+	// Recording starts before the copy so any write it misses is recorded
+	db.swapWrites(writeSet{})
+	defer db.swapWrites(nil)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return compactCopy(dst, tx)
+	})
+
+	for i := 0; err == nil && i < compactRounds; i++ {
+		ws := db.swapWrites(writeSet{})
+		if len(ws) == 0 {
+			break
+		}
+		err = db.compactWrites(dst, ws)
+	}
+
+	if err == nil {
+		db.wmu.Lock()
+		defer db.wmu.Unlock()
+
+		err = db.compactWrites(dst, db.swapWrites(nil))
+	}
+
+	if er := dst.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return 0, err
+	}
+
+	bdb, err := db.replace(tmpname)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	old := db.cur
+	db.cur = &boltFile{db: bdb}
+	db.mu.Unlock()
+
+	go func() {
+		if er := old.close(); er != nil {
+			log.Printf("[ERROR] Failed to close compacted file path=%s error='%v'", db.path, er)
+		}
+	}()
+
+	if fi, err = os.Stat(db.path); err != nil {
+		return 0, err
+	}
+	return size - fi.Size(), nil
+}
+
+// replace renames the compacted file over the database file and opens it.  It
+// is opened at the database path as bolt reopens its path to stream backups.
+// The current file is put back if the compacted one cannot be opened.  The
+// caller must hold the writer lock
+func (db *DB) replace(tmpname string) (*bolt.DB, error) {
+	oldname := db.path + ".old"
+	os.Remove(oldname)
+	if err := os.Link(db.path, oldname); err != nil {
+		os.Remove(tmpname)
+		return nil, err
+	}
+	defer os.Remove(oldname)
+
+	if err := os.Rename(tmpname, db.path); err != nil {
+		os.Remove(tmpname)
+		return nil, err
+	}
+
+	bdb, err := openBolt(db.path, db.conf)
+	if err != nil {
+		if er := os.Rename(oldname, db.path); er != nil {
+			log.Printf("[ERROR] Failed to restore database file path=%s error='%v'", db.path, er)
+		}
+	}
+	return bdb, err
+}
+
+// Compact compacts the underlying database.  For a shared database all stores
+// are compacted.
+func (store *EntryStore) Compact() (int64, error) {
+	return store.db.Compact()
+}
+
+// Compact compacts the underlying database.  For a shared database all stores
+// are compacted.
+func (store *IndexStore) Compact() (int64, error) {
+	return store.db.Compact()
+}
+
+// Compact compacts the underlying database.  For a shared database all stores
+// are compacted.
+func (index *BlockIndex) Compact() (int64, error) {
+	return index.db.Compact()
+}
+
+// compactWrites copies the written keys and the top level bucket sequences
+// from the current file to the destination in a single transaction
+func (db *DB) compactWrites(dst *bolt.DB, ws writeSet) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			for name, keys := range ws {
+				b := []byte(name)
+				sbkt, dbkt := tx.Bucket(b), dtx.Bucket(b)
+				if keys == nil || sbkt == nil || dbkt == nil {
+					if err := compactSyncKey(dtx, tx, b); err != nil {
+						return err
+					}
+					continue
+				}
+
+				for k := range keys {
+					if err := compactSyncKey(dbkt, sbkt, []byte(k)); err != nil {
+						return err
+					}
+				}
+			}
+
+			// Sequences are used as counters and flags so all are copied
+			return tx.ForEach(func(name []byte, sbkt *bolt.Bucket) error {
+				if dbkt := dtx.Bucket(name); dbkt != nil && dbkt.Sequence() != sbkt.Sequence() {
+					return dbkt.SetSequence(sbkt.Sequence())
+				}
+				return nil
+			})
+		})
+	})
+}
+
+// compactCopy copies all buckets from the source transaction to the
+// destination committing every compactTxMaxSize bytes
+func compactCopy(dst *bolt.DB, src *bolt.Tx) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	err = compactWalk(src, func(path [][]byte, k, v []byte, seq uint64) error {
+		// Start a new transaction once the current one is large enough
+		if size += int64(len(k) + len(v)); size > compactTxMaxSize {
+			er := tx.Commit()
+			if er == nil {
+				tx, er = dst.Begin(true)
+			}
+			if er != nil {
+				return er
+			}
+			size = 0
+		}
+
+		// Top level bucket
+		if len(path) == 0 {
+			b, er := tx.CreateBucket(k)
+			if er != nil {
+				return er
+			}
+			return b.SetSequence(seq)
+		}
+
+		b := tx.Bucket(path[0])
+		for _, name := range path[1:] {
+			b = b.Bucket(name)
+		}
+
+		// Nested bucket
+		if v == nil {
+			nb, er := b.CreateBucket(k)
+			if er != nil {
+				return er
+			}
+			return nb.SetSequence(seq)
+		}
+
+		return b.Put(k, v)
+	})
+
+	if err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// compactWalk calls fn for every bucket and key/value pair in the transaction.
+// path is the bucket path containing the key and seq the sequence of a bucket.
+func compactWalk(tx *bolt.Tx, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if err := fn(nil, name, nil, b.Sequence()); err != nil {
+			return err
+		}
+		return compactWalkBucket(b, [][]byte{name}, fn)
+	})
+}
+
+func compactWalkBucket(b *bolt.Bucket, path [][]byte, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return fn(path, k, v, 0)
+		}
+
+		nb := b.Bucket(k)
+		if err := fn(path, k, nil, nb.Sequence()); err != nil {
+			return err
+		}
+
+		p := make([][]byte, len(path)+1)
+		copy(p, path)
+		p[len(path)] = k
+		return compactWalkBucket(nb, p, fn)
+	})
+}
+
+// bucketNode is a transaction or bucket holding nested buckets
+type bucketNode interface {
+	Cursor() *bolt.Cursor
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// compactSyncKey makes the key in the destination match the source whether it
+// is a nested bucket, a value or missing
+func compactSyncKey(dst, src bucketNode, k []byte) error {
+	sbkt, dbkt := src.Bucket(k), dst.Bucket(k)
+	if sbkt != nil {
+		if dbkt == nil {
+			// Replaces a value if any
+			if bkt, ok := dst.(*bolt.Bucket); ok {
+				if err := bkt.Delete(k); err != nil {
+					return err
+				}
+			}
+			var err error
+			if dbkt, err = dst.CreateBucket(k); err != nil {
+				return err
+			}
+		}
+		return compactSync(dbkt, sbkt)
+	}
+
+	if dbkt != nil {
+		if err := dst.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+
+	// The top level only holds buckets
+	bkt, ok := dst.(*bolt.Bucket)
+	if !ok {
+		return nil
+	}
+	if v := src.(*bolt.Bucket).Get(k); v != nil {
+		return bkt.Put(k, v)
+	}
+	return bkt.Delete(k)
+}
+
+// compactSync makes the destination hold the same buckets and key/value pairs
+// as the source.  Both are walked in key order and only the differences are
+// written.
+func compactSync(dst, src bucketNode) error {
+	var (
+		del     [][]byte
+		puts    [][2][]byte
+		created [][]byte
+		common  [][]byte
+	)
+
+	// Changes are collected first as writing while iterating moves the cursor
+	sc, dc := src.Cursor(), dst.Cursor()
+	sk, sv := sc.First()
+	dk, dv := dc.First()
+	for sk != nil || dk != nil {
+		cmp := -1
+		if sk == nil {
+			cmp = 1
+		} else if dk != nil {
+			cmp = bytes.Compare(sk, dk)
+		}
+
+		if cmp > 0 {
+			// Only in the destination
+			del = append(del, append([]byte{}, dk...))
+			dk, dv = dc.Next()
+			continue
+		}
+
+		add := cmp < 0
+		if cmp == 0 {
+			switch {
+			case (sv == nil) != (dv == nil):
+				// Changed between a bucket and a value
+				del = append(del, append([]byte{}, dk...))
+				add = true
+			case sv == nil:
+				common = append(common, sk)
+			case !bytes.Equal(sv, dv):
+				puts = append(puts, [2][]byte{sk, sv})
+			}
+			dk, dv = dc.Next()
+		}
+
+		if add {
+			if sv == nil {
+				created = append(created, sk)
+			} else {
+				puts = append(puts, [2][]byte{sk, sv})
+			}
+		}
+		sk, sv = sc.Next()
+	}
+
+	for _, k := range del {
+		if dst.Bucket(k) != nil {
+			if err := dst.DeleteBucket(k); err != nil {
+				return err
+			}
+		} else if err := dst.(*bolt.Bucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	for _, kv := range puts {
+		if err := dst.(*bolt.Bucket).Put(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range created {
+		b, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		if err = compactSync(b, src.Bucket(k)); err != nil {
+			return err
+		}
+	}
+	for _, k := range common {
+		if err := compactSync(dst.Bucket(k), src.Bucket(k)); err != nil {
+			return err
+		}
+	}
+
+	// Sequences are copied as they are used as counters and flags
+	if sb, ok := src.(*bolt.Bucket); ok {
+		bkt := dst.(*bolt.Bucket)
+		if bkt.Sequence() != sb.Sequence() {
+			return bkt.SetSequence(sb.Sequence())
+		}
+	}
+	return nil
+}
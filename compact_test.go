@@ -0,0 +1,158 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/hexalog"
+)
+
+func Test_EntryStore_Compact(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	store := NewEntryStore()
+	if err := store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ids := make([][]byte, 1000)
+	entries := make([]*hexalog.Entry, 1000)
+	for i := range ids {
+		ids[i] = []byte(fmt.Sprintf("id-%04d", i))
+		entries[i] = &hexalog.Entry{Key: []byte("key"), Data: make([]byte, 1024)}
+	}
+	if _, err := store.SetBatch(ids, entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[1:] {
+		if err := store.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n <= 0 {
+		t.Fatal("should have reclaimed space", n)
+	}
+
+	// Store should be usable after the swap
+	if _, err = store.Get(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Set(ids[1], entries[1]); err != nil {
+		t.Fatal(err)
+	}
+	if store.Count() != 2 {
+		t.Fatal("should have 2 entries", store.Count())
+	}
+
+	// Backups stream the compacted file
+	buf := new(bytes.Buffer)
+	if _, err = store.Backup(buf); err != nil {
+		t.Fatal(err)
+	}
+	restoredir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(restoredir)
+
+	restored := NewEntryStore()
+	if err = restored.Restore(buf, restoredir); err != nil {
+		t.Fatal(err)
+	}
+	if err = restored.Open(restoredir); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if restored.Count() != 2 {
+		t.Fatal("backup should have 2 entries", restored.Count())
+	}
+}
+
+// Writers and nested reads keep running during compaction
+func Test_EntryStore_Compact_concurrent(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	store := NewEntryStore(WithNoSync(true))
+	if err := store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 1000; i++ {
+		ent := &hexalog.Entry{Key: []byte("key"), Data: make([]byte, 1024)}
+		if err := store.Set([]byte(fmt.Sprintf("id-%04d", i)), ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan int)
+	go func() {
+		var n int
+		for ; ; n++ {
+			select {
+			case <-stop:
+				done <- n
+				return
+			default:
+			}
+
+			ent := &hexalog.Entry{Key: []byte("key"), Timestamp: uint64(n)}
+			if err := store.Set([]byte(fmt.Sprintf("new-%04d", n)), ent); err != nil {
+				t.Error(err)
+			}
+			if err := store.Delete([]byte(fmt.Sprintf("id-%04d", n%1000))); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	viewed := make(chan struct{})
+	go func() {
+		defer close(viewed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Read from within a read transaction
+			store.Iter(&IterOptions{Limit: 1}, func(id []byte, entry *hexalog.Entry) error {
+				_, err := store.Get(id)
+				return err
+			})
+		}
+	}()
+
+	if _, err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	n := <-done
+	<-viewed
+
+	for i := 0; i < n; i++ {
+		if _, err := store.Get([]byte(fmt.Sprintf("new-%04d", i))); err != nil {
+			t.Fatal("write during compaction lost", i, err)
+		}
+	}
+	if n < 1000 {
+		if _, err := store.Get([]byte(fmt.Sprintf("id-%04d", n))); err != nil {
+			t.Fatal("entry should not be deleted", n, err)
+		}
+	}
+	if _, err := store.Get([]byte("id-0000")); n > 0 && err == nil {
+		t.Fatal("delete during compaction lost")
+	}
+	// Index keys written during compaction are copied along with the entries
+	if ids, _ := store.TimeRange(0, 0, 0); int64(len(ids)) != store.Count() {
+		t.Fatal("time index out of sync", len(ids), store.Count())
+	}
+}
@@ -0,0 +1,119 @@
+package hexaboltdb
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+)
+
+// WalkOptions are the options used to walk a chain of entries
+type WalkOptions struct {
+	// Walk forward to the children of each entry instead of back to its
+	// Previous.  Children are visited breadth first in id order so every branch
+	// after a fork is walked
+	Forward bool
+	// Maximum number of links followed from the starting entry.  Zero means no
+	// limit
+	Depth int
+	// Called with each entry after the callback.  Returning true ends the walk
+	Stop func(id []byte, entry *hexalog.Entry) bool
+}
+
+// BrokenLinkError is returned by a backward walk that reached an entry whose
+// Previous is not in the store
+type BrokenLinkError struct {
+	// Id of the last entry reached
+	ID []byte
+	// Missing previous id
+	Previous []byte
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("broken link id=%x previous=%x", e.ID, e.Previous)
+}
+
+// Walk walks the chain of entries starting at id within a single read
+// transaction calling cb with each entry including the first.  A nil opt walks
+// back to the first entry of the keylog.  A backward walk that cannot follow a
+// Previous returns a BrokenLinkError once the callbacks are done.  Values that
+// cannot be decoded stop the walk with an error.  Returning an error from the
+// callback stops the walk and returns the error.
+func (store *EntryStore) Walk(id []byte, opt *WalkOptions, cb func(id []byte, entry *hexalog.Entry) error) error {
+	if opt == nil {
+		opt = &WalkOptions{}
+	}
+
+	return store.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(store.bucket)
+
+		// Ids to visit along with their depth
+		next := [][]byte{append([]byte{}, id...)}
+		depth := map[string]int{string(id): 0}
+
+		for n := 0; len(next) > 0; n++ {
+			id := next[0]
+			next = next[1:]
+
+			value := bkt.Get(id)
+			if value == nil {
+				if n == 0 {
+					return hexatype.ErrEntryNotFound
+				}
+				// Stale children index key
+				continue
+			}
+
+			var entry hexalog.Entry
+			if err := proto.Unmarshal(value, &entry); err != nil {
+				return fmt.Errorf("corrupt entry id=%x: %v", id, err)
+			}
+
+			if err := cb(id, &entry); err != nil {
+				return err
+			}
+			if opt.Stop != nil && opt.Stop(id, &entry) {
+				return nil
+			}
+
+			d := depth[string(id)] + 1
+			if opt.Depth > 0 && d > opt.Depth {
+				continue
+			}
+
+			var links [][]byte
+			if opt.Forward {
+				links = store.children(tx, entry.Key, id)
+			} else if !isZeroID(entry.Previous) {
+				if bkt.Get(entry.Previous) == nil {
+					return &BrokenLinkError{ID: id, Previous: append([]byte{}, entry.Previous...)}
+				}
+				links = [][]byte{append([]byte{}, entry.Previous...)}
+			}
+
+			for _, link := range links {
+				// Guard against cycles in corrupt data
+				if _, ok := depth[string(link)]; ok {
+					continue
+				}
+				depth[string(link)] = d
+				next = append(next, link)
+			}
+		}
+
+		return nil
+	})
+}
+
+// isZeroID returns true if the id is empty or all zeros as is the Previous of
+// the first entry of a keylog
+func isZeroID(id []byte) bool {
+	for _, b := range id {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
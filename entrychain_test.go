@@ -0,0 +1,71 @@
+package hexaboltdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+)
+
+func Test_EntryStore_Walk(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexalog-")
+	defer os.RemoveAll(tmpdir)
+
+	store := NewEntryStore()
+	if err := store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	key := []byte("key")
+	// a <- b <- c and b <- d
+	for _, link := range [][2]string{{"a", string(make([]byte, 32))}, {"b", "a"}, {"c", "b"}, {"d", "b"}} {
+		ent := &hexalog.Entry{Key: key, Previous: []byte(link[1])}
+		if err := store.Set([]byte(link[0]), ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(id string, opt *WalkOptions) (string, error) {
+		var ids string
+		err := store.Walk([]byte(id), opt, func(id []byte, entry *hexalog.Entry) error {
+			ids += string(id)
+			return nil
+		})
+		return ids, err
+	}
+
+	if ids, err := walk("c", nil); err != nil || ids != "cba" {
+		t.Fatal("wrong backward walk", ids, err)
+	}
+	if ids, err := walk("a", &WalkOptions{Forward: true}); err != nil || ids != "abcd" {
+		t.Fatal("wrong forward walk", ids, err)
+	}
+	if ids, _ := walk("c", &WalkOptions{Depth: 1}); ids != "cb" {
+		t.Fatal("should stop at depth", ids)
+	}
+	stop := func(id []byte, entry *hexalog.Entry) bool { return string(id) == "b" }
+	if ids, _ := walk("a", &WalkOptions{Forward: true, Stop: stop}); ids != "ab" {
+		t.Fatal("should stop on condition", ids)
+	}
+	if _, err := walk("x", nil); err != hexatype.ErrEntryNotFound {
+		t.Fatal("should fail with not found", err)
+	}
+
+	if err := store.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := walk("d", nil)
+	if ids != "db" {
+		t.Fatal("wrong walk before broken link", ids)
+	}
+	be, ok := err.(*BrokenLinkError)
+	if !ok {
+		t.Fatal("should report broken link", err)
+	}
+	if string(be.ID) != "b" || string(be.Previous) != "a" {
+		t.Fatal("wrong broken link", be)
+	}
+}
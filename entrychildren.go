@@ -0,0 +1,155 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+	"github.com/hexablock/hexalog"
+)
+
+// ForkPoint is an entry with more than one child in a keylog, i.e. a point
+// where the keylog forked
+type ForkPoint struct {
+	// Id the children have as their Previous
+	Previous []byte
+	// Ids of the children in id order
+	Children [][]byte
+}
+
+// childKey returns the children index key uvarint(len(prev)) | prev | id.  The
+// length prefix keeps ids of different lengths from sharing a prefix
+func childKey(prev, id []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(prev)+len(id))
+	n := binary.PutUvarint(buf, uint64(len(prev)))
+	n += copy(buf[n:], prev)
+	n += copy(buf[n:], id)
+	return buf[:n]
+}
+
+// splitChildKey returns the previous id and id of a children index key
+func splitChildKey(k []byte) ([]byte, []byte) {
+	l, n := binary.Uvarint(k)
+	if n <= 0 || uint64(len(k)-n) < l {
+		return nil, nil
+	}
+	return k[n : n+int(l)], k[n+int(l):]
+}
+
+// checkChildIndex returns an error if the entry key cannot be used as a bucket
+// name or the index key is too large
+func checkChildIndex(id []byte, entry *hexalog.Entry) error {
+	if len(entry.Key) == 0 {
+		return nil
+	}
+	if len(entry.Key) > bolt.MaxKeySize || len(childKey(entry.Previous, id)) > bolt.MaxKeySize {
+		return bolt.ErrKeyTooLarge
+	}
+	return nil
+}
+
+// childIndexKey returns the entry key as each key has a bucket in the children
+// index.  Entries without a key are not indexed
+func childIndexKey(id []byte, entry *hexalog.Entry) []byte {
+	if len(entry.Key) == 0 {
+		return nil
+	}
+	return entry.Key
+}
+
+// putChildIndex adds the entry to its key's bucket of the children index.
+// Entries without a key are not indexed
+func putChildIndex(bkt *bolt.Bucket, id []byte, entry *hexalog.Entry) error {
+	if len(entry.Key) == 0 {
+		return nil
+	}
+	kb, err := bkt.CreateBucketIfNotExists(entry.Key)
+	if err != nil {
+		return err
+	}
+	return kb.Put(childKey(entry.Previous, id), []byte{})
+}
+
+// deleteChildIndex removes the entry from the children index dropping the
+// key's bucket once it is empty
+func deleteChildIndex(bkt *bolt.Bucket, id []byte, entry *hexalog.Entry) error {
+	if len(entry.Key) == 0 {
+		return nil
+	}
+	kb := bkt.Bucket(entry.Key)
+	if kb == nil {
+		return nil
+	}
+	if err := kb.Delete(childKey(entry.Previous, id)); err != nil {
+		return err
+	}
+	if k, _ := kb.Cursor().First(); k == nil {
+		return bkt.DeleteBucket(entry.Key)
+	}
+	return nil
+}
+
+// Children returns the ids of the key's stored entries whose Previous is id in
+// id order.  More than one child means the keylog forked at id.
+func (store *EntryStore) Children(key, id []byte) ([][]byte, error) {
+	var ids [][]byte
+	err := store.db.View(func(tx *bolt.Tx) error {
+		ids = store.children(tx, key, id)
+		return nil
+	})
+	return ids, err
+}
+
+// children returns copies of the ids of the key's entries whose Previous is id
+// within the transaction
+func (store *EntryStore) children(tx *bolt.Tx, key, id []byte) [][]byte {
+	kb := tx.Bucket(store.cbucket).Bucket(key)
+	if kb == nil {
+		return nil
+	}
+
+	var ids [][]byte
+	prefix := childKey(id, nil)
+	c := kb.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, append([]byte{}, k[len(prefix):]...))
+	}
+	return ids
+}
+
+// Forks returns every fork point of the key's stored entries ordered by the id
+// the children share.  It reads only the children index so it can be used on a
+// read-only store.
+func (store *EntryStore) Forks(key []byte) ([]ForkPoint, error) {
+	var forks []ForkPoint
+	err := store.db.View(func(tx *bolt.Tx) error {
+		kb := tx.Bucket(store.cbucket).Bucket(key)
+		if kb == nil {
+			return nil
+		}
+
+		var fp ForkPoint
+		flush := func() {
+			if len(fp.Children) > 1 {
+				forks = append(forks, fp)
+			}
+		}
+
+		c := kb.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			prev, id := splitChildKey(k)
+			if prev == nil {
+				continue
+			}
+			if !bytes.Equal(prev, fp.Previous) {
+				flush()
+				fp = ForkPoint{Previous: append([]byte{}, prev...)}
+			}
+			fp.Children = append(fp.Children, append([]byte{}, id...))
+		}
+		flush()
+
+		return nil
+	})
+	return forks, err
+}
@@ -0,0 +1,63 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/hexalog"
+)
+
+func Test_EntryStore_Children(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexalog-")
+	defer os.RemoveAll(tmpdir)
+
+	store := NewEntryStore()
+	if err := store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	key := []byte("key")
+	root := make([]byte, 32)
+	// b and c fork from a
+	for _, link := range [][2]string{{"a", string(root)}, {"b", "a"}, {"c", "a"}, {"d", "b"}} {
+		ent := &hexalog.Entry{Key: key, Previous: []byte(link[1])}
+		if err := store.Set([]byte(link[0]), ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	children, err := store.Children(key, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || string(children[0]) != "b" || string(children[1]) != "c" {
+		t.Fatal("wrong children", len(children))
+	}
+	if children, _ = store.Children(key, root); len(children) != 1 {
+		t.Fatal("root should have 1 child", len(children))
+	}
+	if children, _ = store.Children([]byte("other"), []byte("a")); len(children) != 0 {
+		t.Fatal("other key should have no children")
+	}
+
+	forks, err := store.Forks(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forks) != 1 {
+		t.Fatal("should have 1 fork", len(forks))
+	}
+	if !bytes.Equal(forks[0].Previous, []byte("a")) || len(forks[0].Children) != 2 {
+		t.Fatal("wrong fork point")
+	}
+
+	if err = store.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if forks, _ = store.Forks(key); len(forks) != 0 {
+		t.Fatal("should have no forks", len(forks))
+	}
+}
@@ -0,0 +1,169 @@
+package hexaboltdb
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/log"
+)
+
+// Bucket sequence set on a secondary index bucket once it has been built for
+// all existing entries
+const indexBuilt = 1
+
+// entryIndex is a secondary index over stored entries kept in its own bucket.
+// It is updated within the same transaction as the entries.
+type entryIndex struct {
+	bucket []byte
+	// Returns an error if the entry cannot be indexed.  Checked before anything
+	// is written so an entry that cannot be indexed is not stored at all
+	check  func(id []byte, entry *hexalog.Entry) error
+	put    func(bkt *bolt.Bucket, id []byte, entry *hexalog.Entry) error
+	delete func(bkt *bolt.Bucket, id []byte, entry *hexalog.Entry) error
+	// Returns the top level key in the bucket written for the entry or nil if
+	// the entry is not indexed
+	key func(id []byte, entry *hexalog.Entry) []byte
+}
+
+// track records the index key of the entry as written for compaction
+func (ei *entryIndex) track(db *DB, tx *bolt.Tx, id []byte, entry *hexalog.Entry) {
+	if k := ei.key(id, entry); k != nil {
+		db.track(tx, ei.bucket, k)
+	}
+}
+
+// buckets returns the entry bucket followed by all secondary index buckets
+func (store *EntryStore) buckets() [][]byte {
+	buckets := [][]byte{store.bucket}
+	for _, ei := range store.indexes {
+		buckets = append(buckets, ei.bucket)
+	}
+	return buckets
+}
+
+// check returns the error bolt would return writing the entry or any of its
+// secondary index keys
+func (store *EntryStore) check(id []byte, entry *hexalog.Entry, value []byte) error {
+	if len(id) == 0 {
+		return bolt.ErrKeyRequired
+	} else if len(id) > bolt.MaxKeySize {
+		return bolt.ErrKeyTooLarge
+	} else if len(value) > bolt.MaxValueSize {
+		return bolt.ErrValueTooLarge
+	}
+
+	for _, ei := range store.indexes {
+		if err := ei.check(id, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index adds the secondary index keys of the entry
+func (store *EntryStore) index(tx *bolt.Tx, id []byte, entry *hexalog.Entry) error {
+	for _, ei := range store.indexes {
+		if err := ei.put(tx.Bucket(ei.bucket), id, entry); err != nil {
+			return err
+		}
+		ei.track(store.db, tx, id, entry)
+	}
+	return nil
+}
+
+// unindex removes the secondary index keys of the stored value if any.  The
+// keys of a value that cannot be decoded are left behind as lookups skip ids
+// that no longer exist.
+func (store *EntryStore) unindex(tx *bolt.Tx, id, value []byte) error {
+	if value == nil {
+		return nil
+	}
+
+	var entry hexalog.Entry
+	if err := proto.Unmarshal(value, &entry); err != nil {
+		log.Printf("[WARN] Failed to deserialize Entry id=%x", id)
+		return nil
+	}
+
+	for _, ei := range store.indexes {
+		if err := ei.delete(tx.Bucket(ei.bucket), id, &entry); err != nil {
+			return err
+		}
+		ei.track(store.db, tx, id, &entry)
+	}
+	return nil
+}
+
+// backfill builds the secondary indexes not yet built for entries written
+// before they were maintained.  Entries are indexed in batches to bound
+// transaction size.  It is a no-op once all indexes have been built.
+func (store *EntryStore) backfill() error {
+	var (
+		last  []byte
+		total int
+	)
+	for {
+		var done bool
+		err := store.db.Update(func(tx *bolt.Tx) error {
+			var pending []*entryIndex
+			for _, ei := range store.indexes {
+				if tx.Bucket(ei.bucket).Sequence() != indexBuilt {
+					pending = append(pending, ei)
+				}
+			}
+			if len(pending) == 0 {
+				done = true
+				return nil
+			}
+
+			c := tx.Bucket(store.bucket).Cursor()
+			k, v := c.First()
+			if last != nil {
+				// Resume after the last entry of the previous batch
+				if k, v = c.Seek(last); k != nil && bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+
+			n := 0
+			for ; k != nil && n < maxFlushBatch; k, v = c.Next() {
+				last = append(last[:0], k...)
+
+				var entry hexalog.Entry
+				if err := proto.Unmarshal(v, &entry); err != nil {
+					log.Printf("[WARN] Failed to deserialize Entry id=%x", k)
+					continue
+				}
+				for _, ei := range pending {
+					if err := ei.put(tx.Bucket(ei.bucket), k, &entry); err != nil {
+						return err
+					}
+					ei.track(store.db, tx, k, &entry)
+				}
+				n++
+			}
+			total += n
+
+			if k != nil {
+				return nil
+			}
+
+			done = true
+			for _, ei := range pending {
+				if err := tx.Bucket(ei.bucket).SetSequence(indexBuilt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		if err != nil || done {
+			if err == nil && total > 0 {
+				log.Printf("[INFO] Built entry indexes bucket=%s count=%d", store.bucket, total)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/log"
+)
+
+// CorruptPolicy determines how iteration handles stored values that cannot be
+// decoded
+type CorruptPolicy int
+
+const (
+	// CorruptSkip logs and skips values that cannot be decoded
+	CorruptSkip CorruptPolicy = iota
+	// CorruptStop stops iterating and returns the decode error
+	CorruptStop
+	// CorruptCollect skips values that cannot be decoded and returns their ids
+	// in a CorruptEntriesError once iteration completes
+	CorruptCollect
+)
+
+// CorruptEntriesError is returned by iteration with the CorruptCollect policy
+// when one or more values could not be decoded
+type CorruptEntriesError struct {
+	IDs [][]byte
+}
+
+func (e *CorruptEntriesError) Error() string {
+	return fmt.Sprintf("%d corrupt entries", len(e.IDs))
+}
+
+// IterOptions are the options used to iterate over stored entries
+type IterOptions struct {
+	// Id to start iterating from.  Iteration starts at the first entry if not set
+	Seek []byte
+	// Only iterate over ids with the prefix
+	Prefix []byte
+	// Maximum number of entries to return.  Zero means no limit
+	Limit int
+	// How to handle values that cannot be decoded
+	OnCorrupt CorruptPolicy
+}
+
+// Iter iterates over the stored entries in id order based on the options.  A
+// nil opt iterates over all entries skipping those that cannot be decoded.
+// Returning an error from the callback stops iteration and returns the error.
+func (store *EntryStore) Iter(opt *IterOptions, cb func(id []byte, entry *hexalog.Entry) error) error {
+	if opt == nil {
+		opt = &IterOptions{}
+	}
+
+	seek := opt.Seek
+	if bytes.Compare(seek, opt.Prefix) < 0 {
+		seek = opt.Prefix
+	}
+
+	var corrupt [][]byte
+	err := store.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(store.bucket).Cursor()
+
+		var k, v []byte
+		if len(seek) == 0 {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(seek)
+		}
+
+		for n := 0; k != nil; k, v = c.Next() {
+			if !bytes.HasPrefix(k, opt.Prefix) {
+				break
+			}
+
+			id := append([]byte{}, k...)
+
+			var entry hexalog.Entry
+			if err := proto.Unmarshal(v, &entry); err != nil {
+				switch opt.OnCorrupt {
+				case CorruptStop:
+					return fmt.Errorf("corrupt entry id=%x: %v", id, err)
+				case CorruptCollect:
+					corrupt = append(corrupt, id)
+				default:
+					log.Printf("[WARN] Failed to deserialize Entry id=%x", id)
+				}
+				continue
+			}
+
+			if err := cb(id, &entry); err != nil {
+				return err
+			}
+
+			if n++; opt.Limit > 0 && n >= opt.Limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil && len(corrupt) > 0 {
+		err = &CorruptEntriesError{IDs: corrupt}
+	}
+
+	return err
+}
@@ -1,8 +1,7 @@
 package hexaboltdb
 
 import (
-	"os"
-	"path/filepath"
+	"errors"
 
 	"github.com/boltdb/bolt"
 	"github.com/golang/protobuf/proto"
@@ -10,21 +9,39 @@ import (
 	"github.com/hexablock/hexatype"
 )
 
+var (
+	errBatchMismatch = errors.New("id and entry count mismatch")
+)
+
 // EntryStore is an entry store using rocksdb as the backend
 type EntryStore struct {
-	opt    *bolt.Options
+	conf   *config
 	bucket []byte
-	mode   os.FileMode
-	db     *bolt.DB
+	// Boltdb buckets indexing entries by timestamp and by previous id along
+	// with all secondary indexes
+	tbucket []byte
+	cbucket []byte
+	indexes []*entryIndex
+	db      *DB
+	// Whether the db is shared and owned by the caller
+	shared bool
 }
 
-// NewEntryStore inits a new rocksdb backed entry store with defaults
-func NewEntryStore() *EntryStore {
-	return &EntryStore{
-		opt:    bolt.DefaultOptions,
-		bucket: []byte("entries"),
-		mode:   0755,
+// NewEntryStore inits a new boltdb backed entry store.  Options not given use
+// their defaults
+func NewEntryStore(opts ...Option) *EntryStore {
+	conf := newConfig("entries.db", "entries", opts)
+	store := &EntryStore{
+		conf:    conf,
+		bucket:  conf.bucket,
+		tbucket: append(append([]byte{}, conf.bucket...), ".time"...),
+		cbucket: append(append([]byte{}, conf.bucket...), ".children"...),
+	}
+	store.indexes = []*entryIndex{
+		{bucket: store.tbucket, check: checkTimeIndex, put: putTimeIndex, delete: deleteTimeIndex, key: timeIndexKey},
+		{bucket: store.cbucket, check: checkChildIndex, put: putChildIndex, delete: deleteChildIndex, key: childIndexKey},
 	}
+	return store
 }
 
 // Name returns the name of the rocksdb entry store
@@ -32,16 +49,29 @@ func (store *EntryStore) Name() string {
 	return dbname
 }
 
-// Open opens the rocks store for writing
+// Open opens the rocks store for writing.  Secondary indexes missing for
+// entries written by older versions are built.
 func (store *EntryStore) Open(datadir string) error {
-	filename := filepath.Join(datadir, "entries.db")
-	db, err := bolt.Open(filename, store.mode, store.opt)
+	db, err := openDB(datadir, store.conf, store.buckets()...)
 	if err == nil {
 		store.db = db
-		err = db.Update(func(tx *bolt.Tx) error {
-			_, er := tx.CreateBucketIfNotExists(store.bucket)
-			return er
-		})
+		if !db.ReadOnly() {
+			err = store.backfill()
+		}
+	}
+	return err
+}
+
+// OpenDB opens the store using a shared database building any missing
+// secondary indexes.  Closing the store does not close the shared database.
+func (store *EntryStore) OpenDB(db *DB) error {
+	err := db.createBuckets(store.buckets()...)
+	if err == nil {
+		store.db = db
+		store.shared = true
+		if !db.ReadOnly() {
+			err = store.backfill()
+		}
 	}
 	return err
 }
@@ -63,23 +93,60 @@ func (store *EntryStore) Get(id []byte) (*hexalog.Entry, error) {
 	return &entry, err
 }
 
-// Set sets the entry to the store by the id
+// Set sets the entry to the store by the id.  Concurrent calls are coalesced
+// into a single transaction
 func (store *EntryStore) Set(id []byte, entry *hexalog.Entry) error {
 	value, err := proto.Marshal(entry)
 	if err == nil {
-		err = store.db.Update(func(tx *bolt.Tx) error {
-			bkt := tx.Bucket(store.bucket)
-			return bkt.Put(id, value)
+		err = store.check(id, entry, value)
+	}
+	if err == nil {
+		err = store.db.Batch(func(tx *bolt.Tx) error {
+			return store.put(tx, id, entry, value)
 		})
 	}
 	return err
 }
 
+// SetBatch sets multiple entries in a single transaction.  It returns an error
+// per entry in the order given where a nil error means the entry was written.
+// Entries are checked up front and those that fail do not prevent the others
+// from being written.  A non-nil second return value means the transaction
+// failed and nothing was written.
+func (store *EntryStore) SetBatch(ids [][]byte, entries []*hexalog.Entry) ([]error, error) {
+	if len(ids) != len(entries) {
+		return nil, errBatchMismatch
+	}
+
+	errs := make([]error, len(entries))
+	values := make([][]byte, len(entries))
+	for i, entry := range entries {
+		if values[i], errs[i] = proto.Marshal(entry); errs[i] == nil {
+			errs[i] = store.check(ids[i], entry, values[i])
+		}
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		for i, id := range ids {
+			if errs[i] != nil {
+				continue
+			}
+			// An entry may be partially written so nothing is committed
+			if er := store.put(tx, id, entries[i], values[i]); er != nil {
+				return er
+			}
+		}
+		return nil
+	})
+
+	return errs, err
+}
+
 // Delete deletes an entry by the id
 func (store *EntryStore) Delete(id []byte) error {
 	return store.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(store.bucket)
-		return bkt.Delete(id)
+		_, err := store.delete(tx, id)
+		return err
 	})
 }
 
@@ -94,7 +161,41 @@ func (store *EntryStore) Count() int64 {
 	return c
 }
 
-// Close closes the rocks store after which it can no longer be used.
+// put writes the marshalled entry along with its secondary index keys within
+// the transaction
+func (store *EntryStore) put(tx *bolt.Tx, id []byte, entry *hexalog.Entry, value []byte) error {
+	bkt := tx.Bucket(store.bucket)
+	// Replace the index keys of an existing entry
+	if err := store.unindex(tx, id, bkt.Get(id)); err != nil {
+		return err
+	}
+	if err := bkt.Put(id, value); err != nil {
+		return err
+	}
+	store.db.track(tx, store.bucket, id)
+	return store.index(tx, id, entry)
+}
+
+// delete deletes the entry and its secondary index keys within the
+// transaction.  It returns false if the entry did not exist
+func (store *EntryStore) delete(tx *bolt.Tx, id []byte) (bool, error) {
+	bkt := tx.Bucket(store.bucket)
+	value := bkt.Get(id)
+	if value == nil {
+		return false, nil
+	}
+	if err := store.unindex(tx, id, value); err != nil {
+		return false, err
+	}
+	store.db.track(tx, store.bucket, id)
+	return true, bkt.Delete(id)
+}
+
+// Close closes the store after which it can no longer be used.  A shared
+// database is left open.
 func (store *EntryStore) Close() error {
+	if store.shared {
+		return nil
+	}
 	return store.db.Close()
 }
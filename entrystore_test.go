@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/hexablock/hexalog"
 	"github.com/hexablock/hexatype"
 	"github.com/hexablock/log"
@@ -74,3 +75,157 @@ func Test_EntryStore(t *testing.T) {
 	}
 
 }
+
+func Test_EntryStore_SetBatch(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexalog-")
+	defer os.RemoveAll(tmpdir)
+
+	rdb := NewEntryStore(WithMaxBatchSize(10), WithMaxBatchDelay(time.Millisecond))
+	if err := rdb.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+
+	ids := make([][]byte, 5)
+	entries := make([]*hexalog.Entry, 5)
+	for i := range entries {
+		entries[i] = &hexalog.Entry{
+			Previous:  make([]byte, 32),
+			Key:       []byte("key"),
+			Timestamp: uint64(time.Now().UnixNano()) + uint64(i),
+		}
+		ids[i] = entries[i].Hash(sha256.New())
+	}
+	// Empty keys are rejected by bolt
+	ids[2] = []byte{}
+
+	if _, err := rdb.SetBatch(ids[:2], entries); err != errBatchMismatch {
+		t.Fatalf("should fail with='%v' got='%v'", errBatchMismatch, err)
+	}
+
+	errs, err := rdb.SetBatch(ids, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, er := range errs {
+		if i == 2 {
+			if er == nil {
+				t.Error("empty id should fail")
+			}
+		} else if er != nil {
+			t.Errorf("entry %d failed: %v", i, er)
+		}
+	}
+
+	if rdb.Count() != 4 {
+		t.Fatal("should have 4 entries", rdb.Count())
+	}
+}
+
+func Test_EntryStore_SetBatch_unindexable(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexalog-")
+	defer os.RemoveAll(tmpdir)
+
+	rdb := NewEntryStore()
+	if err := rdb.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+
+	ids := [][]byte{[]byte("a"), []byte("b")}
+	entries := []*hexalog.Entry{
+		{Key: []byte("key"), Timestamp: 1},
+		// Key too large to be a children index bucket
+		{Key: make([]byte, bolt.MaxKeySize+1), Timestamp: 2},
+	}
+
+	errs, err := rdb.SetBatch(ids, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[1] != bolt.ErrKeyTooLarge {
+		t.Fatal("only the unindexable entry should fail", errs)
+	}
+
+	// Nothing of the failed entry is written
+	if _, err = rdb.Get(ids[1]); err != hexatype.ErrEntryNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrEntryNotFound, err)
+	}
+	rdb.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(rdb.tbucket).Stats().KeyN; n != 1 {
+			t.Error("failed entry should not be indexed", n)
+		}
+		return nil
+	})
+	if err = rdb.Set([]byte("c"), entries[1]); err != bolt.ErrKeyTooLarge {
+		t.Fatalf("should fail with='%v' got='%v'", bolt.ErrKeyTooLarge, err)
+	}
+}
+
+func Test_EntryStore_Iter(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexalog-")
+	defer os.RemoveAll(tmpdir)
+
+	rdb := NewEntryStore()
+	if err := rdb.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+
+	for i := 0; i < 10; i++ {
+		ent := &hexalog.Entry{Key: []byte("key"), Height: uint32(i + 1)}
+		if err := rdb.Set([]byte{byte(i / 5), byte(i)}, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt value
+	rdb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(rdb.bucket).Put([]byte{1, 6}, []byte{0xff, 0xff})
+	})
+
+	var n int
+	err := rdb.Iter(&IterOptions{Prefix: []byte{1}}, func(id []byte, entry *hexalog.Entry) error {
+		if id[0] != 1 {
+			t.Errorf("prefix mismatch %x", id)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatal("should have 4 entries", n)
+	}
+
+	n = 0
+	err = rdb.Iter(&IterOptions{Seek: []byte{0, 3}, Limit: 3}, func(id []byte, entry *hexalog.Entry) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatal("should have 3 entries", n)
+	}
+
+	err = rdb.Iter(&IterOptions{OnCorrupt: CorruptStop}, func(id []byte, entry *hexalog.Entry) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("should fail on corrupt entry")
+	}
+
+	err = rdb.Iter(&IterOptions{OnCorrupt: CorruptCollect}, func(id []byte, entry *hexalog.Entry) error {
+		return nil
+	})
+	cerr, ok := err.(*CorruptEntriesError)
+	if !ok {
+		t.Fatalf("should fail with CorruptEntriesError got='%v'", err)
+	}
+	if len(cerr.IDs) != 1 || !bytes.Equal(cerr.IDs[0], []byte{1, 6}) {
+		t.Fatalf("wrong corrupt ids %x", cerr.IDs)
+	}
+}
@@ -0,0 +1,90 @@
+package hexaboltdb
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/log"
+)
+
+// timeKey returns the timestamp index key timestamp | id
+func timeKey(ts uint64, id []byte) []byte {
+	return append(uint64Bytes(ts), id...)
+}
+
+func checkTimeIndex(id []byte, entry *hexalog.Entry) error {
+	if 8+len(id) > bolt.MaxKeySize {
+		return bolt.ErrKeyTooLarge
+	}
+	return nil
+}
+
+func timeIndexKey(id []byte, entry *hexalog.Entry) []byte {
+	return timeKey(entry.Timestamp, id)
+}
+
+func putTimeIndex(bkt *bolt.Bucket, id []byte, entry *hexalog.Entry) error {
+	return bkt.Put(timeKey(entry.Timestamp, id), []byte{})
+}
+
+func deleteTimeIndex(bkt *bolt.Bucket, id []byte, entry *hexalog.Entry) error {
+	return bkt.Delete(timeKey(entry.Timestamp, id))
+}
+
+// TimeRange returns the ids of entries with a timestamp in [start, end) in time
+// order.  Entries with the same timestamp are in id order.  An end of zero has
+// no upper bound.  A non-zero limit caps the number of ids returned.
+func (store *EntryStore) TimeRange(start, end uint64, limit int) ([][]byte, error) {
+	var ids [][]byte
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return store.scanTime(tx, start, end, func(id []byte) (bool, error) {
+			ids = append(ids, append([]byte{}, id...))
+			return limit <= 0 || len(ids) < limit, nil
+		})
+	})
+	return ids, err
+}
+
+// IterTime iterates over entries with a timestamp in [start, end) in time order
+// within a single read transaction.  An end of zero has no upper bound.  Values
+// that cannot be decoded are logged and skipped.  Returning an error from the
+// callback stops iteration and returns the error.
+func (store *EntryStore) IterTime(start, end uint64, cb func(id []byte, entry *hexalog.Entry) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(store.bucket)
+		return store.scanTime(tx, start, end, func(id []byte) (bool, error) {
+			var entry hexalog.Entry
+			if err := proto.Unmarshal(bkt.Get(id), &entry); err != nil {
+				log.Printf("[WARN] Failed to deserialize Entry id=%x", id)
+				return true, nil
+			}
+			return true, cb(append([]byte{}, id...), &entry)
+		})
+	})
+}
+
+// scanTime calls fn with the id of each stored entry in the timestamp range
+// until fn returns false or an error.  Index keys left behind for entries that
+// no longer exist are skipped.
+func (store *EntryStore) scanTime(tx *bolt.Tx, start, end uint64, fn func(id []byte) (bool, error)) error {
+	bkt := tx.Bucket(store.bucket)
+	c := tx.Bucket(store.tbucket).Cursor()
+
+	for k, _ := c.Seek(uint64Bytes(start)); k != nil; k, _ = c.Next() {
+		if end > 0 && binary.BigEndian.Uint64(k[:8]) >= end {
+			break
+		}
+
+		id := k[8:]
+		if bkt.Get(id) == nil {
+			continue
+		}
+		ok, err := fn(id)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
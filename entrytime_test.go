@@ -0,0 +1,85 @@
+package hexaboltdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+)
+
+func Test_EntryStore_TimeRange(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexalog-")
+	defer os.RemoveAll(tmpdir)
+
+	store := NewEntryStore()
+	if err := store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, ts := range map[string]uint64{"a": 30, "b": 10, "c": 20} {
+		ent := &hexalog.Entry{Key: []byte("key"), Timestamp: ts}
+		if err := store.Set([]byte(id), ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := store.TimeRange(10, 30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || string(ids[0]) != "b" || string(ids[1]) != "c" {
+		t.Fatal("wrong ids in range", len(ids))
+	}
+	if ids, _ = store.TimeRange(0, 0, 1); len(ids) != 1 {
+		t.Fatal("should limit ids", len(ids))
+	}
+
+	var last uint64
+	err = store.IterTime(0, 0, func(id []byte, entry *hexalog.Entry) error {
+		if entry.Timestamp < last {
+			t.Fatal("entries out of time order")
+		}
+		last = entry.Timestamp
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ = store.TimeRange(0, 0, 0); len(ids) != 2 {
+		t.Fatal("deleted entry should not be in range", len(ids))
+	}
+
+	// Write an entry the way older versions did and mark the index unbuilt
+	value, _ := proto.Marshal(&hexalog.Entry{Key: []byte("key"), Timestamp: 5})
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		if er := tx.Bucket(store.bucket).Put([]byte("d"), value); er != nil {
+			return er
+		}
+		return tx.Bucket(store.tbucket).SetSequence(0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store = NewEntryStore()
+	if err = store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ids, err = store.TimeRange(0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || string(ids[0]) != "d" {
+		t.Fatal("entry should be indexed on open", len(ids))
+	}
+}
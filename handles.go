@@ -2,9 +2,14 @@ package hexaboltdb
 
 import (
 	"errors"
+	"hash/fnv"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/hexablock/hexatype"
 	"github.com/hexablock/log"
 )
@@ -13,42 +18,127 @@ var (
 	errIndexOpen = errors.New("KeylogIndex is open")
 )
 
+const (
+	// Maximum number of indexes written in a single flush transaction
+	maxFlushBatch = 1000
+	// Number of lock striped shards in the open handle table
+	handleShards = 32
+)
+
 type indexHandle struct {
-	cnt      int
+	cnt int
+	// Number of references taken since the handle was opened
+	refs     int
 	lastUsed time.Time
+	// Time the ref count last went from zero to one
+	heldSince time.Time
+	// Call stack of the last acquire when debugging handles
+	stack string
 	*KeylogIndex
 }
 
-type openIndexes struct {
+// HandleInfo describes an open KeylogIndex handle
+type HandleInfo struct {
+	Key []byte
+	// Number of outstanding references
+	Refs     int
+	LastUsed time.Time
+	// Time the handle has been continuously referenced since.  Zero if idle
+	HeldSince time.Time
+	// Whether the index has changes not yet flushed
+	Dirty bool
+	// Call stack of the last acquire.  Only recorded in debug mode
+	Stack string
+}
+
+// handleShard is a lock striped portion of the open handle table.  All
+// reference count changes happen under the shard lock.
+type handleShard struct {
 	mu sync.RWMutex
 	m  map[string]*indexHandle
+	// Keys that cannot be opened while their index is being removed.  The
+	// channel is closed once the removal is done
+	reserved map[string]chan struct{}
+}
+
+// wait blocks while the key is reserved.  The caller must hold the shard write
+// lock which is held again on return
+func (sh *handleShard) wait(k string) {
+	for {
+		ch, ok := sh.reserved[k]
+		if !ok {
+			return
+		}
+		sh.mu.Unlock()
+		<-ch
+		sh.mu.Lock()
+	}
+}
+
+type openIndexes struct {
+	// Number of handles evicted to stay within the limits.  Accessed
+	// atomically and kept first for 64-bit alignment
+	evictions uint64
+
+	shards [handleShards]*handleShard
+	// Serializes batch flushes as each holds the flush lock of many indexes
+	fmu sync.Mutex
 	// Interval for flush loop
 	flushInt time.Duration
 	// Time to wait after lastChanged before issuing a flush
 	flushWait time.Duration
-
+	// Limits on open handles and their estimated memory.  Zero means no limit
+	maxHandles int
+	maxBytes   int64
+	// Handles referenced for longer than this are logged along with their
+	// acquiring call stacks.  Zero disables handle debugging
+	leakThreshold time.Duration
+
+	// Signals the flush loop to evict handles
+	evictCh  chan struct{}
 	shutdown chan struct{}
 	stopped  chan struct{}
 }
 
-func newOpenIndexes() *openIndexes {
+func newOpenIndexes(conf *config) *openIndexes {
 	oi := &openIndexes{
-		m:         make(map[string]*indexHandle),
-		flushInt:  60 * time.Second,
-		flushWait: 15 * time.Second,
-		shutdown:  make(chan struct{}, 1),
-		stopped:   make(chan struct{}, 1),
+		flushInt:   conf.flushInterval,
+		flushWait:  conf.flushWait,
+		maxHandles: conf.maxOpenKeys,
+		maxBytes:   conf.maxIndexMemory,
+
+		leakThreshold: conf.handleDebug,
+		evictCh:       make(chan struct{}, 1),
+		shutdown:      make(chan struct{}, 1),
+		stopped:       make(chan struct{}, 1),
+	}
+	for i := range oi.shards {
+		oi.shards[i] = &handleShard{
+			m:        make(map[string]*indexHandle),
+			reserved: make(map[string]chan struct{}),
+		}
 	}
 	go oi.flush()
 
 	return oi
 }
 
+// shard returns the shard holding the key
+func (oi *openIndexes) shard(key []byte) *handleShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return oi.shards[h.Sum32()%handleShards]
+}
+
 func (oi *openIndexes) flush() {
 	for {
 		select {
 		case <-time.After(oi.flushInt):
 			oi.flushOnce()
+			oi.evict()
+			oi.logLeaks()
+		case <-oi.evictCh:
+			oi.evict()
 		case <-oi.shutdown:
 			oi.stopped <- struct{}{}
 			//log.Println("[DEBUG] Open indexes stopped!")
@@ -57,128 +147,521 @@ func (oi *openIndexes) flush() {
 	}
 }
 
+// flushOnce flushes idle dirty indexes and evicts idle handles that have
+// nothing left to write.  Candidates are collected under the lock while the
+// disk I/O happens outside of it so handles can be acquired and released
+// during a flush.
 func (oi *openIndexes) flushOnce() {
-	var err error
-
-	oi.mu.Lock()
-	for k, v := range oi.m {
-		// Skip recently used ones
-		if time.Since(v.lastUsed) <= oi.flushWait {
-			continue
+	var dirty []*KeylogIndex
+
+	for _, sh := range oi.shards {
+		sh.mu.Lock()
+		for k, v := range sh.m {
+			// Nothing to write so idle clean handles are evicted right away
+			if !v.dirty() {
+				if v.cnt == 0 {
+					delete(sh.m, k)
+				}
+				continue
+			}
+
+			// Skip recently used ones
+			if time.Since(v.lastUsed) <= oi.flushWait {
+				continue
+			}
+
+			dirty = append(dirty, v.KeylogIndex)
 		}
+		sh.mu.Unlock()
+	}
 
-		// Flush
-		if err = v.Flush(); err != nil {
-			log.Printf("[ERROR] Flush error: %s", err)
-			continue
-		}
-		// Close/remove index handle
-		if v.cnt == 0 {
-			//log.Printf("[DEBUG] Closing handle key=%s", v.Key())
-			delete(oi.m, k)
+	if len(dirty) == 0 {
+		return
+	}
+
+	flushed, err := oi.flushIndexes(dirty)
+	if err != nil {
+		log.Printf("[ERROR] Flush error: %s", err)
+	}
+
+	// Close/remove flushed index handles.  A handle reacquired during the
+	// flush is only evicted if it has been released and not changed since.
+	for _, idx := range flushed {
+		sh := oi.shard(idx.Key())
+		k := string(idx.Key())
+
+		sh.mu.Lock()
+		if v, ok := sh.m[k]; ok && v.KeylogIndex == idx && v.cnt == 0 && !v.dirty() {
+			//log.Printf("[DEBUG] Closing handle key=%s", k)
+			delete(sh.m, k)
 		}
+		sh.mu.Unlock()
 	}
-	oi.mu.Unlock()
 
 }
 
-func (oi *openIndexes) closeAll() error {
-	var err error
+// flushAll flushes all dirty open indexes without closing them
+func (oi *openIndexes) flushAll() error {
+	_, err := oi.flushIndexes(oi.dirty())
+	return err
+}
 
+func (oi *openIndexes) closeAll() error {
 	oi.shutdown <- struct{}{}
 	<-oi.stopped
 
-	oi.mu.Lock()
-	for _, v := range oi.m {
-		if er := v.Flush(); er != nil {
+	_, err := oi.flushIndexes(oi.dirty())
+
+	for _, sh := range oi.shards {
+		sh.mu.Lock()
+		sh.m = nil
+		sh.mu.Unlock()
+	}
+
+	return err
+}
+
+// dirty returns all dirty open indexes
+func (oi *openIndexes) dirty() []*KeylogIndex {
+	var dirty []*KeylogIndex
+	for _, sh := range oi.shards {
+		sh.mu.RLock()
+		for _, v := range sh.m {
+			if v.dirty() {
+				dirty = append(dirty, v.KeylogIndex)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return dirty
+}
+
+// flushIndexes writes the indexes using one transaction per maxFlushBatch
+// indexes.  An index that fails to marshal or write does not prevent the
+// others from being written.  It returns the indexes written and the last
+// error encountered.
+func (oi *openIndexes) flushIndexes(idxs []*KeylogIndex) ([]*KeylogIndex, error) {
+	oi.fmu.Lock()
+	defer oi.fmu.Unlock()
+
+	var (
+		flushed []*KeylogIndex
+		err     error
+	)
+
+	for len(idxs) > 0 {
+		n := len(idxs)
+		if n > maxFlushBatch {
+			n = maxFlushBatch
+		}
+
+		f, er := flushIndexBatch(idxs[:n])
+		if er != nil {
 			err = er
 		}
+		flushed = append(flushed, f...)
+		idxs = idxs[n:]
 	}
-	oi.m = nil
-	oi.mu.Unlock()
 
-	return err
+	return flushed, err
 }
 
-// remove is used to remove a key handle and its data directly from memory
-// without flushing its contents
-func (oi *openIndexes) remove(key []byte) error {
+// flushIndexBatch snapshots and writes the indexes in a single transaction.
+// An index that fails to write is dropped and the transaction retried without
+// it so it cannot hold back the others
+func flushIndexBatch(idxs []*KeylogIndex) ([]*KeylogIndex, error) {
+	var (
+		snaps = make([]*indexSnapshot, 0, len(idxs))
+		err   error
+	)
+
+	for _, idx := range idxs {
+		// Held until written so a concurrent flush cannot write an older
+		// snapshot over this one
+		idx.fmu.Lock()
+		defer idx.fmu.Unlock()
+
+		// Removed or replaced since it was collected or already written by
+		// an earlier flush.  Writing it could bring back a removed key
+		if idx.retired || !idx.dirty() {
+			continue
+		}
+
+		snap, er := idx.snapshot()
+		if er != nil {
+			log.Printf("[ERROR] Failed to marshal index key=%s error='%v'", idx.Key(), er)
+			err = er
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+
+	for len(snaps) > 0 {
+		// Index of the snapshot that failed to write
+		failed := -1
+		er := snaps[0].idx.db.Update(func(tx *bolt.Tx) error {
+			for i, snap := range snaps {
+				// A partially written index cannot be undone so abort
+				// rather than commit it or leave its mutations journaled
+				if e := snap.idx.write(tx, snap); e != nil {
+					failed = i
+					return e
+				}
+			}
+			return nil
+		})
+
+		if er == nil {
+			break
+		}
+		err = er
+		if failed < 0 {
+			return nil, er
+		}
+
+		log.Printf("[ERROR] Failed to write index key=%s error='%v'", snaps[failed].idx.Key(), er)
+		snaps = append(snaps[:failed], snaps[failed+1:]...)
+	}
+
+	flushed := make([]*KeylogIndex, 0, len(snaps))
+	for _, snap := range snaps {
+		snap.flushed()
+		flushed = append(flushed, snap.idx)
+	}
+
+	return flushed, err
+}
+
+// reserve takes the key's handle out of the table and keeps the key from being
+// opened until it is unreserved.  It returns the removed index if the key was
+// open.  A key with references or already reserved cannot be reserved.
+func (oi *openIndexes) reserve(key []byte) (*KeylogIndex, error) {
 	k := string(key)
+	sh := oi.shard(key)
 
-	oi.mu.Lock()
-	defer oi.mu.Unlock()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	ih, ok := oi.m[k]
-	if !ok {
-		return hexatype.ErrKeyNotFound
+	if _, ok := sh.reserved[k]; ok {
+		return nil, errIndexOpen
 	}
 
-	if ih.cnt > 0 {
-		return errIndexOpen
+	ih, ok := sh.m[k]
+	if ok && ih.cnt > 0 {
+		return nil, errIndexOpen
 	}
 
-	// mark for deletion
-	delete(oi.m, k)
-	return nil
+	delete(sh.m, k)
+	sh.reserved[k] = make(chan struct{})
+	if ok {
+		return ih.KeylogIndex, nil
+	}
+	return nil, nil
+}
+
+// discard takes the index out of the table and reserves its key if the caller
+// holds the only reference ever taken to it.  It returns false leaving the
+// handle as is if the key has been held by others or is open with a different
+// index.
+func (oi *openIndexes) discard(kli *KeylogIndex) bool {
+	k := string(kli.Key())
+	sh := oi.shard(kli.Key())
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	ih, ok := sh.m[k]
+	if !ok || ih.KeylogIndex != kli || ih.cnt != 1 || ih.refs != 1 {
+		return false
+	}
+
+	delete(sh.m, k)
+	sh.reserved[k] = make(chan struct{})
+	return true
 }
 
-func (oi *openIndexes) close(key []byte) error {
+// unreserve allows the key to be opened again.  A non-nil kli is put back in
+// the table as an idle handle.
+func (oi *openIndexes) unreserve(key []byte, kli *KeylogIndex) {
 	k := string(key)
+	sh := oi.shard(key)
 
-	oi.mu.Lock()
-	defer oi.mu.Unlock()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	val, ok := oi.m[k]
+	// The table is nil once closed
+	if kli != nil && sh.m != nil {
+		sh.m[k] = &indexHandle{KeylogIndex: kli, lastUsed: time.Now()}
+	}
+	close(sh.reserved[k])
+	delete(sh.reserved, k)
+}
+
+// close releases a reference to the index.  A reference held to an index that
+// has since been force released, evicted or replaced is not counted against
+// the handle now open for the key.
+func (oi *openIndexes) close(idx *KeylogIndex) error {
+	key := idx.Key()
+	sh := oi.shard(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	val, ok := sh.m[string(key)]
 	if !ok {
 		return hexatype.ErrKeyNotFound
 	}
 
+	// The handle may have been force released
+	if val.KeylogIndex != idx || val.cnt == 0 {
+		log.Printf("[WARN] Handle closed with no references key=%s", key)
+		return nil
+	}
+
 	val.cnt--
 	val.lastUsed = time.Now()
+	if val.cnt == 0 {
+		val.heldSince = time.Time{}
+	}
 	return nil
 }
 
-// get an open index and up the ref count
+// ref ups the ref count of the handle.  The caller must hold the shard lock
+func (oi *openIndexes) ref(ih *indexHandle) {
+	if ih.cnt == 0 {
+		ih.heldSince = time.Now()
+	}
+	ih.cnt++
+	ih.refs++
+
+	if oi.leakThreshold > 0 {
+		ih.stack = string(debug.Stack())
+	}
+}
+
+// info returns a description of all open handles
+func (oi *openIndexes) info() []HandleInfo {
+	var out []HandleInfo
+	for _, sh := range oi.shards {
+		sh.mu.RLock()
+		for _, v := range sh.m {
+			out = append(out, HandleInfo{
+				Key:       v.Key(),
+				Refs:      v.cnt,
+				LastUsed:  v.lastUsed,
+				HeldSince: v.heldSince,
+				Dirty:     v.dirty(),
+				Stack:     v.stack,
+			})
+		}
+		sh.mu.RUnlock()
+	}
+	return out
+}
+
+// logLeaks logs handles referenced for longer than the leak threshold
+func (oi *openIndexes) logLeaks() {
+	if oi.leakThreshold <= 0 {
+		return
+	}
+
+	for _, hi := range oi.info() {
+		if hi.Refs > 0 && time.Since(hi.HeldSince) > oi.leakThreshold {
+			log.Printf("[WARN] Handle held too long key=%s refs=%d held=%s stack:\n%s",
+				hi.Key, hi.Refs, time.Since(hi.HeldSince), hi.Stack)
+		}
+	}
+}
+
+// forceRelease drops all references to the key's handle so it can be flushed
+// and evicted.  The index is replaced by a copy so releasing a dropped
+// reference does not count against the handle.  It returns the number of
+// references dropped.
+func (oi *openIndexes) forceRelease(key []byte) (int, error) {
+	k := string(key)
+	sh := oi.shard(key)
+
+	sh.mu.Lock()
+	sh.wait(k)
+	ih, ok := sh.m[k]
+	if !ok {
+		sh.mu.Unlock()
+		return 0, hexatype.ErrKeyNotFound
+	}
+	n := ih.cnt
+	// Keep the key from being opened until the copy is in place
+	delete(sh.m, k)
+	sh.reserved[k] = make(chan struct{})
+	sh.mu.Unlock()
+
+	oi.unreserve(key, ih.clone())
+	return n, nil
+}
+
+// get an open index and up the ref count.  The lookup and increment happen
+// under the same lock so the handle cannot be evicted in between.  It waits
+// while the key is reserved.
 func (oi *openIndexes) get(key []byte) (*indexHandle, bool) {
-	oi.mu.RLock()
-	ih, ok := oi.m[string(key)]
+	sh := oi.shard(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.wait(string(key))
+
+	ih, ok := sh.m[string(key)]
 	if !ok {
-		oi.mu.RUnlock()
 		return nil, false
-		//log.Printf("[DEBUG] Index handles action=open key=%s count=%d", key, ih.cnt)
 	}
-	oi.mu.RUnlock()
 
 	//log.Printf("[DEBUG] Handle opened: %s", key)
+	oi.ref(ih)
 
-	oi.mu.Lock()
-	defer oi.mu.Unlock()
-	ih.cnt++
+	return ih, true
+}
+
+// acquire registers the index with a ref count of 1 returning it and true.  If
+// the key is already open the existing index is returned with its ref count
+// upped along with false.  It waits while the key is reserved.
+func (oi *openIndexes) acquire(kli *KeylogIndex) (*KeylogIndex, bool) {
+	k := string(kli.Key())
+	sh := oi.shard(kli.Key())
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.wait(k)
+
+	if ih, ok := sh.m[k]; ok {
+		oi.ref(ih)
+		return ih.KeylogIndex, false
+	}
+
+	ih := &indexHandle{KeylogIndex: kli, lastUsed: time.Now()}
+	oi.ref(ih)
+	sh.m[k] = ih
+
+	// Have the flush loop evict handles if a limit has been exceeded
+	if oi.maxHandles > 0 || oi.maxBytes > 0 {
+		select {
+		case oi.evictCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return kli, true
+}
 
-	return ih, ok
+// dirtyCount returns the number of open indexes with unflushed changes
+func (oi *openIndexes) dirtyCount() int {
+	var n int
+	for _, sh := range oi.shards {
+		sh.mu.RLock()
+		for _, v := range sh.m {
+			if v.dirty() {
+				n++
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// memSize returns the estimated memory used by all open indexes
+func (oi *openIndexes) memSize() int64 {
+	var n int64
+	for _, sh := range oi.shards {
+		sh.mu.RLock()
+		for _, v := range sh.m {
+			n += v.memSize()
+		}
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// evict flushes and evicts the least recently used idle handles until the
+// open handles are within the configured limits.  Handles in use are never
+// evicted so the limits may be exceeded while they are held.
+func (oi *openIndexes) evict() {
+	count, size := oi.count(), oi.memSize()
+	over := func() bool {
+		return (oi.maxHandles > 0 && count > oi.maxHandles) ||
+			(oi.maxBytes > 0 && size > oi.maxBytes)
+	}
+	if !over() {
+		return
+	}
+
+	type candidate struct {
+		idx      *KeylogIndex
+		lastUsed time.Time
+		size     int64
+	}
+
+	var idle []candidate
+	for _, sh := range oi.shards {
+		sh.mu.RLock()
+		for _, v := range sh.m {
+			if v.cnt == 0 {
+				idle = append(idle, candidate{v.KeylogIndex, v.lastUsed, v.memSize()})
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastUsed.Before(idle[j].lastUsed) })
+
+	// Pick the oldest until within the limits
+	var victims, dirty []*KeylogIndex
+	for _, c := range idle {
+		if !over() {
+			break
+		}
+		victims = append(victims, c.idx)
+		if c.idx.dirty() {
+			dirty = append(dirty, c.idx)
+		}
+		count--
+		size -= c.size
+	}
+
+	if _, err := oi.flushIndexes(dirty); err != nil {
+		log.Printf("[ERROR] Flush error: %s", err)
+	}
+
+	// Failed flushes leave the index dirty and in place
+	for _, idx := range victims {
+		sh := oi.shard(idx.Key())
+		k := string(idx.Key())
+
+		sh.mu.Lock()
+		if v, ok := sh.m[k]; ok && v.KeylogIndex == idx && v.cnt == 0 && !v.dirty() {
+			delete(sh.m, k)
+			atomic.AddUint64(&oi.evictions, 1)
+		}
+		sh.mu.Unlock()
+	}
 }
 
 func (oi *openIndexes) count() int {
-	oi.mu.RLock()
-	defer oi.mu.RUnlock()
-	return len(oi.m)
+	var n int
+	for _, sh := range oi.shards {
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n
 }
 
 // isOpen returns true if the index handle exists.  It returns true even though
 // the count may be zero as the data may not have been flushed.
 func (oi *openIndexes) isOpen(key []byte) (int, bool) {
-	oi.mu.RLock()
-	defer oi.mu.RUnlock()
+	sh := oi.shard(key)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	ih, ok := oi.m[string(key)]
+	ih, ok := sh.m[string(key)]
 	if ok {
 		return ih.cnt, true
 	}
 	return 0, false
 }
-
-func (oi *openIndexes) register(kli *KeylogIndex) {
-	oi.mu.Lock()
-	oi.m[string(kli.Key())] = &indexHandle{cnt: 1, KeylogIndex: kli, lastUsed: time.Now()}
-	oi.mu.Unlock()
-}
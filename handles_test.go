@@ -0,0 +1,306 @@
+package hexaboltdb
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+)
+
+func Test_openIndexes_acquire(t *testing.T) {
+	oi := newOpenIndexes(newConfig("", "", []Option{WithFlushInterval(time.Hour)}))
+	defer oi.closeAll()
+
+	kli := &KeylogIndex{key: []byte("key"), idx: hexalog.NewUnsafeKeylogIndex([]byte("key")), kh: oi}
+	if idx, ok := oi.acquire(kli); !ok || idx != kli {
+		t.Fatal("should register index")
+	}
+
+	other := &KeylogIndex{key: []byte("key"), idx: hexalog.NewUnsafeKeylogIndex([]byte("key")), kh: oi}
+	idx, ok := oi.acquire(other)
+	if ok || idx != kli {
+		t.Fatal("should return existing index")
+	}
+	if cnt, _ := oi.isOpen([]byte("key")); cnt != 2 {
+		t.Fatal("should have 2 handles", cnt)
+	}
+}
+
+func Test_openIndexes_reserve(t *testing.T) {
+	oi := newOpenIndexes(newConfig("", "", []Option{WithFlushInterval(time.Hour)}))
+	defer oi.closeAll()
+
+	kli := &KeylogIndex{key: []byte("key"), idx: hexalog.NewUnsafeKeylogIndex([]byte("key")), kh: oi}
+	oi.acquire(kli)
+	if _, err := oi.reserve([]byte("key")); err != errIndexOpen {
+		t.Fatal("should not reserve a referenced key", err)
+	}
+	kli.Close()
+
+	idx, err := oi.reserve([]byte("key"))
+	if err != nil || idx != kli {
+		t.Fatal("should reserve and return the open index", err)
+	}
+	if _, err = oi.reserve([]byte("key")); err != errIndexOpen {
+		t.Fatal("should not reserve twice", err)
+	}
+
+	// Opening waits until the key is unreserved
+	got := make(chan *KeylogIndex)
+	go func() {
+		other := &KeylogIndex{key: []byte("key"), idx: hexalog.NewUnsafeKeylogIndex([]byte("key")), kh: oi}
+		idx, _ := oi.acquire(other)
+		got <- idx
+	}()
+	select {
+	case <-got:
+		t.Fatal("should wait for the reservation")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	oi.unreserve([]byte("key"), kli)
+	if idx = <-got; idx != kli {
+		t.Fatal("should get the index put back")
+	}
+}
+
+// Many goroutines opening, appending and closing the same and different keys
+// while the flush loop runs.  Meant to be run with -race
+func Test_IndexStore_handles_stress(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithFlushWait(0), WithNoSync(true))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	const (
+		workers = 16
+		rounds  = 50
+	)
+
+	stop := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				idxs.openIdxs.flushOnce()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			// Own key appended to by this goroutine only
+			key := []byte(fmt.Sprintf("key-%d", w))
+			prev := make([]byte, 32)
+			for i := 0; i < rounds; i++ {
+				// Shared key opened and closed by all goroutines
+				shared, err := idxs.MarkKey([]byte("shared"), []byte(fmt.Sprintf("%d-%d", w, i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				ki, err := idxs.GetKey(key)
+				if err != nil {
+					if ki, err = idxs.NewKey(key); err != nil {
+						errs <- err
+						return
+					}
+				}
+
+				id := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", key, i)))
+				if err = ki.Append(id[:], prev, uint64(i+1)); err != nil {
+					errs <- err
+					return
+				}
+				prev = id[:]
+
+				ki.Close()
+				shared.Close()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-flushed
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for w := 0; w < workers; w++ {
+		key := []byte(fmt.Sprintf("key-%d", w))
+		if cnt, ok := idxs.openIdxs.isOpen(key); ok && cnt != 0 {
+			t.Fatalf("key=%s should have no open handles have=%d", key, cnt)
+		}
+
+		ki, err := idxs.GetKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ki.Count() != rounds {
+			t.Fatalf("key=%s count mismatch want=%d have=%d", key, rounds, ki.Count())
+		}
+		ki.Close()
+	}
+
+	if cnt, ok := idxs.openIdxs.isOpen([]byte("shared")); ok && cnt != 0 {
+		t.Fatalf("shared key should have no open handles have=%d", cnt)
+	}
+}
+
+func Test_openIndexes_evict(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithMaxOpenKeys(5))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	// Held handle should never be evicted
+	held, err := idxs.NewKey([]byte("held"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	for i := 0; i < 10; i++ {
+		ki, err := idxs.NewKey([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ki.Close()
+		time.Sleep(time.Millisecond)
+	}
+
+	idxs.openIdxs.evict()
+
+	stats := idxs.Stats()
+	if stats.OpenKeys != 5 {
+		t.Fatal("should have 5 open keys", stats.OpenKeys)
+	}
+	if stats.Evictions != 6 {
+		t.Fatal("should have 6 evictions", stats.Evictions)
+	}
+	if stats.MemBytes <= 0 {
+		t.Fatal("should have memory estimate")
+	}
+	if _, ok := idxs.openIdxs.isOpen([]byte("held")); !ok {
+		t.Fatal("held key should not be evicted")
+	}
+	// Oldest evicted first
+	if _, ok := idxs.openIdxs.isOpen([]byte("key0")); ok {
+		t.Fatal("least recently used key should be evicted")
+	}
+	if _, ok := idxs.openIdxs.isOpen([]byte("key9")); !ok {
+		t.Fatal("most recently used key should not be evicted")
+	}
+
+	// Evicted keys are flushed before eviction
+	ki, err := idxs.GetKey([]byte("key0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ki.Close()
+}
+
+func Test_IndexStore_OpenHandles(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithHandleDebug(time.Millisecond))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	// Leaked handle
+	leaked, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handles := idxs.OpenHandles()
+	if len(handles) != 1 {
+		t.Fatal("should have 1 handle", len(handles))
+	}
+	hi := handles[0]
+	if string(hi.Key) != "key" || hi.Refs != 1 || !hi.Dirty || hi.HeldSince.IsZero() {
+		t.Fatalf("wrong handle info %+v", hi)
+	}
+	if hi.Stack == "" {
+		t.Fatal("should record acquiring stack")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	idxs.openIdxs.logLeaks()
+
+	n, err := idxs.ForceRelease([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("should release 1 reference", n)
+	}
+	if cnt, _ := idxs.openIdxs.isOpen([]byte("key")); cnt != 0 {
+		t.Fatal("should have no references", cnt)
+	}
+
+	if err = leaked.Flush(); err != errIndexRetired {
+		t.Fatalf("should fail with='%v' got='%v'", errIndexRetired, err)
+	}
+
+	// Closing the leaked reference after the key was reopened leaves the new
+	// handle alone whether or not it was evicted in between
+	ki, err := idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaked.Close()
+	if cnt, _ := idxs.openIdxs.isOpen([]byte("key")); cnt != 1 {
+		t.Fatal("stale close should not release the reacquired handle", cnt)
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ki.Close()
+
+	idxs.openIdxs.flushOnce()
+	if _, ok := idxs.openIdxs.isOpen([]byte("key")); ok {
+		t.Fatal("idle handle should be evicted")
+	}
+	if ki, err = idxs.GetKey([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	leaked.Close()
+	if cnt, _ := idxs.openIdxs.isOpen([]byte("key")); cnt != 1 {
+		t.Fatal("stale close should not release the reopened handle", cnt)
+	}
+	ki.Close()
+
+	if _, err = idxs.ForceRelease([]byte("foo")); err != hexatype.ErrKeyNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrKeyNotFound, err)
+	}
+}
@@ -1,56 +1,101 @@
 package hexaboltdb
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"sync/atomic"
 
 	"github.com/boltdb/bolt"
-	"github.com/golang/protobuf/proto"
 	"github.com/hexablock/hexalog"
 	"github.com/hexablock/hexatype"
 	"github.com/hexablock/log"
 )
 
+var errInvalidKey = errors.New("invalid key")
+
 // Stats contains store stats
 type Stats struct {
 	Keys     int64
 	OpenKeys int
+	// Open keys with changes not yet flushed
+	DirtyKeys int
+	// Estimated memory used by open keys in bytes
+	MemBytes int64
+	// Number of open keys evicted to stay within the configured limits
+	Evictions uint64
+}
+
+// KeylogReader is the read-only view of a KeylogIndex
+type KeylogReader interface {
+	Key() []byte
+	Marker() []byte
+	Last() []byte
+	Contains(id []byte) bool
+	Iter(seek []byte, cb func(id []byte) error) error
+	Count() int
+	Height() uint32
+	EntryAt(height uint32) ([]byte, error)
+	EntryAtLTime(ltime uint64) ([]byte, error)
+	Index() hexalog.UnsafeKeylogIndex
 }
 
 // IndexStore implements an rocksdb KeylogIndex store interface
 type IndexStore struct {
-	db  *bolt.DB
-	opt *bolt.Options
+	db   *DB
+	conf *config
+	// Whether the db is shared and owned by the caller
+	shared bool
 	// Boltdb bucket for indexes
 	bucket []byte
-	// DB file mode
-	mode os.FileMode
+	// Boltdb bucket for the index mutation journal
+	jbucket []byte
+	// Boltdb bucket for markers
+	mbucket []byte
 
 	// Open indexes
 	openIdxs *openIndexes
 }
 
-// NewIndexStore initializes an in-memory store for KeylogIndexes.
-func NewIndexStore() *IndexStore {
+// NewIndexStore initializes a boltdb backed store for KeylogIndexes.  Options
+// not given use their defaults
+func NewIndexStore(opts ...Option) *IndexStore {
+	conf := newConfig("index.db", "index", opts)
 	return &IndexStore{
-		openIdxs: newOpenIndexes(),
-		opt:      bolt.DefaultOptions,
-		bucket:   []byte("index"),
-		mode:     0755,
+		openIdxs: newOpenIndexes(conf),
+		conf:     conf,
+		bucket:   conf.bucket,
+		jbucket:  append(append([]byte{}, conf.bucket...), ".journal"...),
+		mbucket:  append(append([]byte{}, conf.bucket...), ".markers"...),
 	}
 }
 
-// Open opens the index store for usage
+// Open opens the index store for usage.  Indexes stored by older versions are
+// migrated, any journaled mutations not yet flushed are replayed onto the
+// stored indexes and markers are reloaded
 func (store *IndexStore) Open(dir string) error {
-	filename := filepath.Join(dir, "index.db")
-	db, err := bolt.Open(filename, store.mode, store.opt)
+	db, err := openDB(dir, store.conf, store.bucket, store.jbucket, store.mbucket)
 	if err == nil {
 		store.db = db
-		err = db.Update(func(tx *bolt.Tx) error {
-			_, er := tx.CreateBucketIfNotExists(store.bucket)
-			return er
-		})
+		// Journaled mutations cannot be replayed onto a read-only db
+		if !db.ReadOnly() {
+			err = store.upgrade()
+		}
+	}
+	return err
+}
+
+// OpenDB opens the store using a shared database replaying any journaled
+// mutations.  Closing the store flushes open indexes but does not close the
+// shared database.
+func (store *IndexStore) OpenDB(db *DB) error {
+	err := db.createBuckets(store.bucket, store.jbucket, store.mbucket)
+	if err == nil {
+		store.db = db
+		store.shared = true
+		if !db.ReadOnly() {
+			err = store.upgrade()
+		}
 	}
 	return err
 }
@@ -58,8 +103,11 @@ func (store *IndexStore) Open(dir string) error {
 // Stats returns statistics about the store
 func (store *IndexStore) Stats() *Stats {
 	return &Stats{
-		Keys:     store.Count(),
-		OpenKeys: store.openIdxs.count(),
+		Keys:      store.Count(),
+		OpenKeys:  store.openIdxs.count(),
+		DirtyKeys: store.openIdxs.dirtyCount(),
+		MemBytes:  store.openIdxs.memSize(),
+		Evictions: atomic.LoadUint64(&store.openIdxs.evictions),
 	}
 }
 
@@ -69,15 +117,17 @@ func (store *IndexStore) Name() string {
 }
 
 // NewKey creates a new KeylogIndex and adds it to the store.  It returns an error if it
-// already exists
+// already exists or the key is empty or longer than bolt.MaxKeySize
 func (store *IndexStore) NewKey(key []byte) (hexalog.KeylogIndex, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
 	if _, ok := store.openIdxs.isOpen(key); ok {
 		return nil, hexatype.ErrKeyExists
 	}
 
 	err := store.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(store.bucket)
-		if d := bkt.Get(key); d != nil {
+		if hasKeylog(tx.Bucket(store.bucket), key) {
 			return hexatype.ErrKeyExists
 		}
 		return nil
@@ -87,53 +137,36 @@ func (store *IndexStore) NewKey(key []byte) (hexalog.KeylogIndex, error) {
 		return nil, err
 	}
 
-	kli := &KeylogIndex{
-		db:     store.db,
-		idx:    hexalog.NewUnsafeKeylogIndex(key),
-		bucket: store.bucket,
-		kh:     store.openIdxs,
+	// Another caller may have created the key in the meantime
+	kli, ok := store.openIdxs.acquire(store.createKeylogIndex(key))
+	if !ok {
+		kli.Close()
+		return nil, hexatype.ErrKeyExists
 	}
-	store.openIdxs.register(kli)
 
 	return kli, nil
 }
 
-// MarkKey sets the marker on a key.  If the key does not exist a new one is created.
-// It returns the KeylogIndex or an error.
+// MarkKey sets the marker on a key.  The marker is persisted and expires after
+// the configured marker TTL if any.  If the key does not exist a new one is
+// created provided it is a valid key.  It returns the KeylogIndex or an error.
 func (store *IndexStore) MarkKey(key, marker []byte) (hexalog.KeylogIndex, error) {
-	if h, ok := store.openIdxs.get(key); ok {
-		_, err := h.SetMarker(marker)
-		return h.KeylogIndex, err
-	}
-
-	var (
-		idx hexalog.KeylogIndex
-		err error
-	)
-
-	idx, err = store.openIndex(key)
-	if err == hexatype.ErrKeyNotFound {
-		// Create a new key
-		kli := &KeylogIndex{
-			db:     store.db,
-			idx:    hexalog.NewUnsafeKeylogIndex(key),
-			bucket: store.bucket,
-			kh:     store.openIdxs,
-		}
-		store.openIdxs.register(kli)
-		idx = kli
-
-	} else if err != nil {
+	kli, _, err := store.getOrCreateKey(key)
+	if err != nil {
 		return nil, err
 	}
 
-	_, err = idx.SetMarker(marker)
+	_, err = kli.SetMarker(marker)
 
-	return idx, err
+	return kli, err
 }
 
 // GetKey returns a KeylogIndex from the store or an error if not found
 func (store *IndexStore) GetKey(key []byte) (hexalog.KeylogIndex, error) {
+	return store.getKey(key)
+}
+
+func (store *IndexStore) getKey(key []byte) (*KeylogIndex, error) {
 	idx, ok := store.openIdxs.get(key)
 	if ok {
 		return idx.KeylogIndex, nil
@@ -142,78 +175,224 @@ func (store *IndexStore) GetKey(key []byte) (hexalog.KeylogIndex, error) {
 	return store.openIndex(key)
 }
 
-// RemoveKey removes the given key's index from the store.  It does NOT remove the associated
-// entry hash id's
-func (store *IndexStore) RemoveKey(key []byte) error {
+// ViewKey calls fn with a read-only view of the key's KeylogIndex.  The handle
+// is always released once fn returns, even if it panics.  The view must not be
+// used outside of fn.
+func (store *IndexStore) ViewKey(key []byte, fn func(KeylogReader) error) error {
+	idx, err := store.getKey(key)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
 
-	err := store.openIdxs.remove(key)
+	return fn(idx)
+}
+
+// UpdateKey calls fn with the key's KeylogIndex creating it if it does not
+// exist.  The handle is always released once fn returns, even if it panics.
+// If flush is true the index is flushed before returning when fn succeeds.  A
+// key created for the call is discarded if fn fails.  A failed flush returns
+// the error keeping the key as its changes are journaled.
+func (store *IndexStore) UpdateKey(key []byte, flush bool, fn func(hexalog.KeylogIndex) error) error {
+	kli, created, err := store.getOrCreateKey(key)
 	if err != nil {
-		if err != hexatype.ErrKeyNotFound {
-			return err
+		return err
+	}
+
+	var failed bool
+	defer func() {
+		// Also drops anything fn journaled before failing.  The handle is
+		// taken out under the shard lock only if no other caller has held it
+		if failed && created && store.openIdxs.discard(kli) {
+			store.removeKey(key, kli)
+			return
 		}
+		kli.Close()
+	}()
+
+	if err = fn(kli); err != nil {
+		failed = true
+		return err
+	}
+	if flush {
+		return kli.Flush()
 	}
+	return nil
+}
 
-	return store.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(store.bucket)
-		val := bkt.Get(key)
-		if val == nil {
-			if err == nil {
-				return nil
+// Sync flushes the key's KeylogIndex if it has unflushed changes and returns
+// once they are durable on disk.  It returns an error if the key does not
+// exist.
+func (store *IndexStore) Sync(key []byte) error {
+	ih, ok := store.openIdxs.get(key)
+	if !ok {
+		// Nothing in memory so whatever is stored is all there is
+		err := store.db.View(func(tx *bolt.Tx) error {
+			if !hasKeylog(tx.Bucket(store.bucket), key) {
+				return hexatype.ErrKeyNotFound
 			}
-			return hexatype.ErrKeyNotFound
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return bkt.Delete(key)
-	})
+		return store.syncDB()
+	}
+	defer ih.Close()
 
+	if ih.dirty() {
+		if err := ih.Flush(); err != nil {
+			return err
+		}
+	}
+	return store.syncDB()
 }
 
-// Iter iterates over each key and index
-func (store *IndexStore) Iter(cb func([]byte, hexalog.KeylogIndex) error) error {
+// SyncAll flushes all KeylogIndexes with unflushed changes and returns once
+// they are durable on disk.
+func (store *IndexStore) SyncAll() error {
+	if err := store.openIdxs.flushAll(); err != nil {
+		return err
+	}
+	return store.syncDB()
+}
 
-	err := store.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(store.bucket)
-		return bkt.ForEach(func(key []byte, val []byte) (err error) {
+// syncDB fsyncs the database if commits are not synced
+func (store *IndexStore) syncDB() error {
+	if store.db.conf.noSync {
+		return store.db.Sync()
+	}
+	return nil
+}
 
-			var idx *KeylogIndex
+// OpenHandles returns a description of all KeylogIndex handles currently held
+// in memory including idle ones not yet evicted
+func (store *IndexStore) OpenHandles() []HandleInfo {
+	return store.openIdxs.info()
+}
 
-			ih, ok := store.openIdxs.get(key)
-			if !ok {
+// ForceRelease drops all references to the key's open handle so it can be
+// flushed and evicted.  It is meant for administrative use to recover from
+// leaked handles.  Holders of the dropped references must not use them
+// afterwards as the index they hold is no longer written.  It returns the number of references dropped.
+func (store *IndexStore) ForceRelease(key []byte) (int, error) {
+	return store.openIdxs.forceRelease(key)
+}
 
-				idx, err = store.makeKeylogIndex(val)
-				if err != nil {
-					log.Println("[ERROR]", err)
-					return nil
+// RemoveKey removes the given key's index from the store.  It does NOT remove the associated
+// entry hash id's
+func (store *IndexStore) RemoveKey(key []byte) error {
+	kli, err := store.openIdxs.reserve(key)
+	if err != nil {
+		return err
+	}
+	return store.removeKey(key, kli)
+}
+
+// removeKey removes the reserved key's index from bolt and unreserves the key.
+// kli is the index taken out of the open handles if any.  It is put back if the
+// removal fails so its unflushed changes are not lost
+func (store *IndexStore) removeKey(key []byte, kli *KeylogIndex) error {
+	if kli != nil {
+		// Wait for a flush already holding the index
+		kli.fmu.Lock()
+		defer kli.fmu.Unlock()
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return store.removeIndex(tx, key, kli != nil)
+	})
+	if err == nil && kli != nil {
+		kli.retired = true
+	}
+
+	if err != nil {
+		store.openIdxs.unreserve(key, kli)
+	} else {
+		store.openIdxs.unreserve(key, nil)
+	}
+	return err
+}
+
+// Iter iterates over each stored key and index.  Keys are listed a batch at a
+// time and the callback is called outside of any transaction so indexes can
+// read entries from bolt on demand.  Keys removed after being listed are
+// skipped.
+func (store *IndexStore) Iter(cb func([]byte, hexalog.KeylogIndex) error) error {
+	var last []byte
+	for {
+		var keys [][]byte
+		err := store.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(store.bucket).Cursor()
+			k, _ := c.First()
+			if last != nil {
+				// Resume after the last key of the previous batch
+				if k, _ = c.Seek(last); k != nil && bytes.Equal(k, last) {
+					k, _ = c.Next()
 				}
+			}
+			for ; k != nil && len(keys) < maxFlushBatch; k, _ = c.Next() {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return err
+		}
 
-			} else {
-				idx = ih.KeylogIndex
-				defer idx.Close()
+		for _, key := range keys {
+			if err = store.iterKey(key, cb); err != nil {
+				return err
 			}
+		}
+		last = keys[len(keys)-1]
+	}
+}
 
-			err = cb(key, idx)
+// iterKey calls cb with the key's index.  An index that is not open is read
+// without being added to the open handles.
+func (store *IndexStore) iterKey(key []byte, cb func([]byte, hexalog.KeylogIndex) error) error {
+	if ih, ok := store.openIdxs.get(key); ok {
+		defer ih.Close()
+		return cb(key, ih.KeylogIndex)
+	}
 
-			return
-		})
+	var idx *KeylogIndex
+	err := store.db.View(func(tx *bolt.Tx) (er error) {
+		idx, er = store.makeKeylogIndex(tx, key, store.conf.keylogTail)
+		return er
 	})
-
-	return err
+	if err == hexatype.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		log.Println("[ERROR]", err)
+		return nil
+	}
+	return cb(key, idx)
 }
 
 // Count returns the total number of keys in the index
 func (store *IndexStore) Count() int64 {
 	var c int64
 	store.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(store.bucket)
-		c = int64(bkt.Stats().KeyN)
+		// Key stats include the nested entry buckets so count the top level
+		cur := tx.Bucket(store.bucket).Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			c++
+		}
 		return nil
 	})
 	return c
 }
 
-// Close closes the index store by flushing all open indexes to rocka then
-// closing rocks
+// Close closes the index store by flushing all open indexes to bolt then
+// closing bolt.  A shared database is left open.
 func (store *IndexStore) Close() error {
 	e1 := store.openIdxs.closeAll()
+	if store.shared {
+		return e1
+	}
+
 	e2 := store.db.Close()
 	if e1 == nil {
 		return e2
@@ -223,40 +402,201 @@ func (store *IndexStore) Close() error {
 	return fmt.Errorf("%s; %s", e1.Error(), e2.Error())
 }
 
-func (store *IndexStore) openIndex(key []byte) (*KeylogIndex, error) {
-	var data []byte
-	err := store.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(store.bucket)
+// removeIndex removes the key's index, marker and any journaled mutations
+// within the transaction.  A key that is not stored is only an error if it was not open
+// either.
+func (store *IndexStore) removeIndex(tx *bolt.Tx, key []byte, open bool) error {
+	for _, b := range [][]byte{store.bucket, store.jbucket, store.mbucket} {
+		store.db.track(tx, b, key)
+	}
+
+	er := tx.Bucket(store.jbucket).DeleteBucket(key)
+	if er != nil && er != bolt.ErrBucketNotFound {
+		return er
+	}
+	if er = tx.Bucket(store.mbucket).Delete(key); er != nil {
+		return er
+	}
 
-		if data = bkt.Get(key); data == nil {
-			return hexatype.ErrKeyNotFound
+	ok, err := deleteKeylog(tx.Bucket(store.bucket), key)
+	if err == nil && !ok && !open {
+		err = hexatype.ErrKeyNotFound
+	}
+	return err
+}
+
+// getOrCreateKey returns the index for the key creating a new one if it does not
+// exist and the key is valid.  It returns true if the index was created.
+func (store *IndexStore) getOrCreateKey(key []byte) (*KeylogIndex, bool, error) {
+	if h, ok := store.openIdxs.get(key); ok {
+		return h.KeylogIndex, false, nil
+	}
+
+	kli, err := store.openIndex(key)
+	if err == hexatype.ErrKeyNotFound {
+		if err = checkKey(key); err != nil {
+			return nil, false, err
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		kli, ok := store.openIdxs.acquire(store.createKeylogIndex(key))
+		return kli, ok, nil
+	}
+
+	return kli, false, err
+}
+
+// checkKey returns an error if the key cannot be stored.  Each key is stored as
+// a bolt bucket so it must be a valid bucket name
+func checkKey(key []byte) error {
+	if len(key) == 0 || len(key) > bolt.MaxKeySize {
+		return errInvalidKey
 	}
+	return nil
+}
 
-	kli, err := store.makeKeylogIndex(data)
+func (store *IndexStore) openIndex(key []byte) (*KeylogIndex, error) {
+	var kli *KeylogIndex
+	err := store.db.View(func(tx *bolt.Tx) (er error) {
+		kli, er = store.makeKeylogIndex(tx, key, store.conf.keylogTail)
+		return er
+	})
 	if err == nil {
-		store.openIdxs.register(kli)
+		// Use the index opened by a concurrent caller if there is one
+		kli, _ = store.openIdxs.acquire(kli)
 	}
 
 	return kli, err
 }
 
-// Unmarshal data to KeylogIndex
-func (store *IndexStore) makeKeylogIndex(data []byte) (*KeylogIndex, error) {
-
-	var ukli hexalog.UnsafeKeylogIndex
-	if err := proto.Unmarshal(data, &ukli); err != nil {
+// Read the key's stored KeylogIndex keeping at most tail entry ids in memory.
+// Zero tail reads all of them
+func (store *IndexStore) makeKeylogIndex(tx *bolt.Tx, key []byte, tail int) (*KeylogIndex, error) {
+	ukli, base, size, err := readKeylog(tx.Bucket(store.bucket), key, tail)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := readMarker(tx.Bucket(store.mbucket), key)
+	if err != nil {
 		return nil, err
 	}
 
+	kli := store.newKeylogIndex(ukli, base)
+	kli.size = size
+	// The markers bucket holds the current marker
+	ukli.Marker = nil
+	if rec != nil {
+		ukli.Marker = rec.marker
+		kli.mexpires = rec.expires
+	}
+	return kli, nil
+}
+
+func (store *IndexStore) newKeylogIndex(ukli *hexalog.UnsafeKeylogIndex, base int) *KeylogIndex {
+	n := base + len(ukli.Entries)
 	return &KeylogIndex{
-		db:     store.db,
-		idx:    &ukli,
-		bucket: store.bucket,
-		kh:     store.openIdxs,
-	}, nil
+		key:     ukli.Key,
+		db:      store.db,
+		idx:     ukli,
+		bucket:  store.bucket,
+		jbucket: store.jbucket,
+		mbucket: store.mbucket,
+		mttl:    store.conf.markerTTL,
+		kh:      store.openIdxs,
+		rows:    n,
+		low:     n,
+		base:    base,
+		tail:    store.conf.keylogTail,
+		ltimes:  make([]uint64, len(ukli.Entries)),
+	}
+}
+
+// createKeylogIndex creates an empty index for a new key.  It starts out dirty
+// as it has not been written yet.
+func (store *IndexStore) createKeylogIndex(key []byte) *KeylogIndex {
+	kli := store.newKeylogIndex(hexalog.NewUnsafeKeylogIndex(key), 0)
+	kli.gen = 1
+	kli.size = int64(len(key))
+	return kli
+}
+
+// upgrade migrates indexes stored by older versions, replays the journal then
+// reloads markers
+func (store *IndexStore) upgrade() error {
+	err := migrateKeylogs(store.db, store.bucket, store.mbucket)
+	if err == nil {
+		err = store.replayJournal()
+	}
+	if err == nil {
+		err = store.reloadMarkers()
+	}
+	return err
+}
+
+// replayJournal applies all journaled mutations to their indexes, writes the
+// indexes and clears the journal in a single transaction.  Mutations that fail
+// to apply are skipped as they would have failed identically when first made.
+func (store *IndexStore) replayJournal() error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(store.bucket)
+		jbkt := tx.Bucket(store.jbucket)
+
+		var keys [][]byte
+		err := jbkt.ForEach(func(k, v []byte) error {
+			if v == nil {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			ukli, _, _, err := readKeylog(bkt, key, 0)
+			if err == hexatype.ErrKeyNotFound {
+				ukli = hexalog.NewUnsafeKeylogIndex(key)
+			} else if err != nil {
+				return err
+			}
+
+			// Only entries from the lowest point a rollback reached are rewritten
+			low := len(ukli.Entries)
+			ltimes := make([]uint64, low)
+			err = jbkt.Bucket(key).ForEach(func(k, v []byte) error {
+				var rec journalRecord
+				if er := rec.UnmarshalBinary(v); er != nil {
+					return er
+				}
+				if er := rec.apply(ukli); er != nil {
+					log.Printf("[WARN] Skipping journal record key=%s seq=%x error='%v'", key, k, er)
+				}
+				if n := len(ukli.Entries); n > len(ltimes) {
+					ltimes = append(ltimes, rec.ltime)
+				} else {
+					ltimes = ltimes[:n]
+				}
+				if len(ukli.Entries) < low {
+					low = len(ukli.Entries)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			header, err := marshalKeylogHeader(ukli)
+			if err != nil {
+				return err
+			}
+			if err = writeKeylog(bkt, key, header, low, ukli.Entries[low:], ltimes[low:]); err != nil {
+				return err
+			}
+			if err = jbkt.DeleteBucket(key); err != nil {
+				return err
+			}
+			store.db.track(tx, store.bucket, key)
+			store.db.track(tx, store.jbucket, key)
+		}
+
+		return nil
+	})
 }
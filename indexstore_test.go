@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/hexablock/hexalog"
 	"github.com/hexablock/hexatype"
 )
@@ -18,7 +21,7 @@ func Test_IndexStore(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := idxs.openIdxs.close([]byte("notfound")); err != hexatype.ErrKeyNotFound {
+	if err := idxs.openIdxs.close(&KeylogIndex{key: []byte("notfound")}); err != hexatype.ErrKeyNotFound {
 		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrKeyNotFound, err)
 	}
 
@@ -56,18 +59,18 @@ func Test_IndexStore(t *testing.T) {
 	if gval.Count() != 1 {
 		t.Fatal("invalid count")
 	}
-	ih, _ := idxs.openIdxs.m["key"]
-	if ih.cnt != 1 {
-		t.Error("should have 1 handle", ih.cnt)
+	cnt, _ := idxs.openIdxs.isOpen([]byte("key"))
+	if cnt != 1 {
+		t.Error("should have 1 handle", cnt)
 	}
 
 	v2, err := idxs.GetKey([]byte("key"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	ih, _ = idxs.openIdxs.m["key"]
-	if ih.cnt != 2 {
-		t.Error("should have 1 handle", ih.cnt)
+	cnt, _ = idxs.openIdxs.isOpen([]byte("key"))
+	if cnt != 2 {
+		t.Error("should have 1 handle", cnt)
 	}
 	r2, ok := v2.(*KeylogIndex)
 	if !ok {
@@ -76,9 +79,9 @@ func Test_IndexStore(t *testing.T) {
 	if err = r2.Close(); err != nil {
 		t.Fatal(err)
 	}
-	ih, _ = idxs.openIdxs.m["key"]
-	if ih.cnt != 1 {
-		t.Error("should have 1 handle", ih.cnt)
+	cnt, _ = idxs.openIdxs.isOpen([]byte("key"))
+	if cnt != 1 {
+		t.Error("should have 1 handle", cnt)
 	}
 
 	// if idxs.Count() != 1 {
@@ -91,8 +94,8 @@ func Test_IndexStore(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	v, _ := idxs.openIdxs.m["key"]
-	if v.cnt != 0 {
+	cnt, _ = idxs.openIdxs.isOpen([]byte("key"))
+	if cnt != 0 {
 		t.Error("should have 0 handles open")
 	}
 
@@ -170,7 +173,7 @@ func Test_IndexStore_MarkKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if idxs.openIdxs.m[string(testkey)].cnt != 2 {
+	if cnt, _ := idxs.openIdxs.isOpen(testkey); cnt != 2 {
 		t.Fatal("should have 2 open handles")
 	}
 
@@ -199,7 +202,7 @@ func Test_IndexStore_MarkKey(t *testing.T) {
 	k2.Close()
 	k3.Close()
 
-	if idxs.openIdxs.m[string(testkey)].cnt != 0 {
+	if cnt, _ := idxs.openIdxs.isOpen(testkey); cnt != 0 {
 		t.Fatal("count should be 0")
 	}
 }
@@ -250,3 +253,387 @@ func Test_IndexStore_Iter(t *testing.T) {
 		t.Fatalf("count mismatch want=20 have=%d", idxs.Count())
 	}
 }
+
+func Test_IndexStore_dirty(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithFlushWait(0))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxs.Stats().DirtyKeys != 1 {
+		t.Fatal("new key should be dirty")
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if idxs.Stats().DirtyKeys != 0 {
+		t.Fatal("flushed key should be clean")
+	}
+
+	if err = ki.Append(make([]byte, 32), make([]byte, 32), 1); err != nil {
+		t.Fatal(err)
+	}
+	if idxs.Stats().DirtyKeys != 1 {
+		t.Fatal("appended key should be dirty")
+	}
+	ki.Close()
+
+	// Dirty key is flushed then evicted
+	idxs.openIdxs.flushOnce()
+	if _, ok := idxs.openIdxs.isOpen([]byte("key")); ok {
+		t.Fatal("key should be evicted")
+	}
+
+	// Read only use leaves the key clean and it is evicted without a flush
+	ki, err = idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.Count() != 1 {
+		t.Fatal("should have 1 entry")
+	}
+	ki.Close()
+
+	if idxs.Stats().DirtyKeys != 0 {
+		t.Fatal("read key should be clean")
+	}
+	idxs.openIdxs.flushOnce()
+	if _, ok := idxs.openIdxs.isOpen([]byte("key")); ok {
+		t.Fatal("clean key should be evicted")
+	}
+}
+
+func Test_IndexStore_flushIndexes(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	for i := 0; i < maxFlushBatch+10; i++ {
+		ki, err := idxs.NewKey([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ki.Close()
+	}
+
+	flushed, err := idxs.openIdxs.flushIndexes(idxs.openIdxs.dirty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != maxFlushBatch+10 {
+		t.Fatalf("should flush %d got %d", maxFlushBatch+10, len(flushed))
+	}
+
+	if idxs.Stats().DirtyKeys != 0 {
+		t.Fatal("should have no dirty keys")
+	}
+	if idxs.Count() != maxFlushBatch+10 {
+		t.Fatalf("count mismatch want=%d have=%d", maxFlushBatch+10, idxs.Count())
+	}
+}
+
+func Test_IndexStore_flushIndexes_failed(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	if _, err := idxs.NewKey([]byte{}); err != errInvalidKey {
+		t.Fatalf("should fail with='%v' got='%v'", errInvalidKey, err)
+	}
+	if _, err := idxs.MarkKey(make([]byte, bolt.MaxKeySize+1), []byte("marker")); err != errInvalidKey {
+		t.Fatalf("should fail with='%v' got='%v'", errInvalidKey, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		ki, err := idxs.NewKey([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ki.Close()
+	}
+	// Index that cannot be written
+	bad, _ := idxs.openIdxs.acquire(idxs.createKeylogIndex([]byte{}))
+	defer bad.Close()
+
+	flushed, err := idxs.openIdxs.flushIndexes(idxs.openIdxs.dirty())
+	if err == nil {
+		t.Fatal("should fail to write the bad index")
+	}
+	if len(flushed) != 10 {
+		t.Fatal("should flush the other indexes", len(flushed))
+	}
+	if idxs.Stats().DirtyKeys != 1 || !bad.dirty() {
+		t.Fatal("only the bad index should be dirty")
+	}
+}
+
+func Test_IndexStore_flushOnce_reacquire(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithFlushWait(0))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ki.Close()
+
+	// Block the write of the index until the handle has been reacquired
+	kli := ki.(*KeylogIndex)
+	kli.fmu.Lock()
+
+	done := make(chan struct{})
+	go func() {
+		idxs.openIdxs.flushOnce()
+		close(done)
+	}()
+
+	// Must not block on the flush in progress
+	ki, err = idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kli.fmu.Unlock()
+	<-done
+
+	if cnt, ok := idxs.openIdxs.isOpen([]byte("key")); !ok || cnt != 1 {
+		t.Fatal("reacquired handle should not be evicted")
+	}
+	ki.Close()
+}
+
+func Test_IndexStore_Remove_flushing(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	entries := NewEntryStore()
+	if err := entries.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer entries.Close()
+
+	removes := map[string]func(key []byte) error{
+		"remove": idxs.RemoveKey,
+		"purge": func(key []byte) error {
+			_, err := idxs.PurgeKey(key, entries)
+			return err
+		},
+	}
+
+	for name, remove := range removes {
+		key := []byte(name)
+		ki, err := idxs.NewKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ki.Append(make([]byte, 32), make([]byte, 32), 1); err != nil {
+			t.Fatal(err)
+		}
+		ki.Close()
+
+		// Block a flush holding the index until the removal has been issued
+		kli := ki.(*KeylogIndex)
+		kli.fmu.Lock()
+
+		flushed := make(chan struct{})
+		go func() {
+			idxs.openIdxs.flushIndexes([]*KeylogIndex{kli})
+			close(flushed)
+		}()
+		removed := make(chan error, 1)
+		go func() {
+			removed <- remove(key)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		kli.fmu.Unlock()
+		if err = <-removed; err != nil {
+			t.Fatal(name, err)
+		}
+		<-flushed
+
+		if _, err = idxs.GetKey(key); err != hexatype.ErrKeyNotFound {
+			t.Fatalf("%s: flush should not write back the key got='%v'", name, err)
+		}
+	}
+}
+
+func Test_IndexStore_ViewKey_UpdateKey(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	key := []byte("key")
+	if err := idxs.ViewKey(key, func(KeylogReader) error { return nil }); err != hexatype.ErrKeyNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrKeyNotFound, err)
+	}
+
+	// Failed update of a new key discards it
+	ferr := fmt.Errorf("failed")
+	err := idxs.UpdateKey(key, false, func(idx hexalog.KeylogIndex) error {
+		if err := idx.Append(make([]byte, 32), make([]byte, 32), 1); err != nil {
+			return err
+		}
+		return ferr
+	})
+	if err != ferr {
+		t.Fatalf("should fail with='%v' got='%v'", ferr, err)
+	}
+	if _, ok := idxs.openIdxs.isOpen(key); ok {
+		t.Fatal("failed new key should be discarded")
+	}
+
+	// A new key also held by another caller is kept
+	other := []byte("other")
+	var held hexalog.KeylogIndex
+	err = idxs.UpdateKey(other, false, func(idx hexalog.KeylogIndex) error {
+		held, _ = idxs.GetKey(other)
+		return ferr
+	})
+	if err != ferr {
+		t.Fatalf("should fail with='%v' got='%v'", ferr, err)
+	}
+	if cnt, ok := idxs.openIdxs.isOpen(other); !ok || cnt != 1 {
+		t.Fatal("key held by another caller should be kept", cnt)
+	}
+	held.Close()
+
+	// As is one another caller has held and released
+	released := []byte("released")
+	err = idxs.UpdateKey(released, false, func(idx hexalog.KeylogIndex) error {
+		h, _ := idxs.GetKey(released)
+		h.Append(make([]byte, 32), make([]byte, 32), 1)
+		h.Close()
+		return ferr
+	})
+	if err != ferr {
+		t.Fatalf("should fail with='%v' got='%v'", ferr, err)
+	}
+	if _, ok := idxs.openIdxs.isOpen(released); !ok {
+		t.Fatal("key changed by another caller should be kept")
+	}
+
+	// A failed flush keeps the new key and its journaled changes
+	unflushed := []byte("unflushed")
+	err = idxs.UpdateKey(unflushed, true, func(idx hexalog.KeylogIndex) error {
+		// Fails the write
+		idx.(*KeylogIndex).retired = true
+		return idx.Append(make([]byte, 32), make([]byte, 32), 1)
+	})
+	if err != errIndexRetired {
+		t.Fatalf("should fail with='%v' got='%v'", errIndexRetired, err)
+	}
+	ih, ok := idxs.openIdxs.get(unflushed)
+	if !ok || ih.Count() != 1 {
+		t.Fatal("key should be kept after a failed flush")
+	}
+	ih.retired = false
+	ih.Close()
+	if err = idxs.SyncAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = idxs.UpdateKey(key, true, func(idx hexalog.KeylogIndex) error {
+		return idx.Append(make([]byte, 32), make([]byte, 32), 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxs.Stats().DirtyKeys != 0 {
+		t.Fatal("update should have flushed")
+	}
+
+	err = idxs.ViewKey(key, func(idx KeylogReader) error {
+		if idx.Count() != 1 {
+			return fmt.Errorf("count mismatch want=1 have=%d", idx.Count())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handle released even on panic
+	func() {
+		defer func() { recover() }()
+		idxs.ViewKey(key, func(KeylogReader) error { panic("view") })
+	}()
+	if cnt, _ := idxs.openIdxs.isOpen(key); cnt != 0 {
+		t.Fatal("should have no open handles", cnt)
+	}
+}
+
+func Test_IndexStore_Sync(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexarocksdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithNoSync(true))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	if err := idxs.Sync([]byte("key")); err != hexatype.ErrKeyNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrKeyNotFound, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		ki, err := idxs.NewKey([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ki.Close()
+	}
+
+	if err := idxs.Sync([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	if idxs.Stats().DirtyKeys != 2 {
+		t.Fatal("should have 2 dirty keys", idxs.Stats().DirtyKeys)
+	}
+
+	if err := idxs.SyncAll(); err != nil {
+		t.Fatal(err)
+	}
+	if idxs.Stats().DirtyKeys != 0 {
+		t.Fatal("should have no dirty keys", idxs.Stats().DirtyKeys)
+	}
+	if idxs.Count() != 3 {
+		t.Fatal("should have 3 keys", idxs.Count())
+	}
+}
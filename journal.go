@@ -0,0 +1,137 @@
+package hexaboltdb
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/boltdb/bolt"
+	"github.com/hexablock/hexalog"
+)
+
+// Journal operation types.  Markers are persisted in their own bucket and are
+// not journaled
+const (
+	journalOpAppend byte = iota + 1
+	journalOpRollback
+)
+
+var errInvalidJournalRecord = errors.New("invalid journal record")
+
+// journalRecord is a single KeylogIndex mutation.  Records are written to the
+// journal bucket before the mutation is applied in-memory and removed once the
+// index has been flushed.
+type journalRecord struct {
+	op    byte
+	ltime uint64
+	// Entry id for appends
+	id   []byte
+	prev []byte
+}
+
+// MarshalBinary encodes the record as op | ltime | uvarint(len(id)) | id | prev
+func (rec *journalRecord) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 9+binary.MaxVarintLen64+len(rec.id)+len(rec.prev))
+	buf[0] = rec.op
+	binary.BigEndian.PutUint64(buf[1:9], rec.ltime)
+	n := 9 + binary.PutUvarint(buf[9:], uint64(len(rec.id)))
+	n += copy(buf[n:], rec.id)
+	n += copy(buf[n:], rec.prev)
+	return buf[:n], nil
+}
+
+// UnmarshalBinary decodes a record encoded with MarshalBinary
+func (rec *journalRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 10 {
+		return errInvalidJournalRecord
+	}
+	rec.op = b[0]
+	rec.ltime = binary.BigEndian.Uint64(b[1:9])
+
+	l, n := binary.Uvarint(b[9:])
+	if n <= 0 || uint64(len(b)-9-n) < l {
+		return errInvalidJournalRecord
+	}
+	s := 9 + n
+	rec.id = append([]byte{}, b[s:s+int(l)]...)
+	rec.prev = append([]byte{}, b[s+int(l):]...)
+	return nil
+}
+
+// apply applies the recorded mutation to the index
+func (rec *journalRecord) apply(idx *hexalog.UnsafeKeylogIndex) error {
+	switch rec.op {
+	case journalOpAppend:
+		return idx.Append(rec.id, rec.prev, rec.ltime)
+	case journalOpRollback:
+		idx.Rollback(rec.ltime)
+	default:
+		return errInvalidJournalRecord
+	}
+	return nil
+}
+
+// writeJournal writes a record for the key to the journal bucket.  Sequence
+// numbers are allocated from the journal bucket itself so they remain
+// monotonic across keys even after a key's records are truncated.
+func writeJournal(db *DB, bucket, key []byte, rec *journalRecord) (uint64, error) {
+	value, err := rec.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	var seq uint64
+	err = db.Update(func(tx *bolt.Tx) error {
+		jbkt := tx.Bucket(bucket)
+		bkt, er := jbkt.CreateBucketIfNotExists(key)
+		if er != nil {
+			return er
+		}
+		if seq, er = jbkt.NextSequence(); er != nil {
+			return er
+		}
+		db.track(tx, bucket, key)
+		return bkt.Put(uint64Bytes(seq), value)
+	})
+
+	return seq, err
+}
+
+// truncateJournal removes all records for the key up to and including seq. The
+// key's journal bucket is removed once it is empty.  It must be called within a
+// writable transaction.
+func truncateJournal(jbkt *bolt.Bucket, key []byte, seq uint64) error {
+	bkt := jbkt.Bucket(key)
+	if bkt == nil {
+		return nil
+	}
+
+	var (
+		keys [][]byte
+		more bool
+	)
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if binary.BigEndian.Uint64(k) > seq {
+			more = true
+			break
+		}
+		keys = append(keys, k)
+	}
+
+	if !more {
+		return jbkt.DeleteBucket(key)
+	}
+
+	for _, k := range keys {
+		if err := bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,131 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hexablock/hexatype"
+)
+
+func Test_journalRecord(t *testing.T) {
+	rec := &journalRecord{op: journalOpAppend, ltime: 7, id: []byte("id"), prev: []byte("prev")}
+	b, _ := rec.MarshalBinary()
+
+	var rec1 journalRecord
+	if err := rec1.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if rec1.op != rec.op || rec1.ltime != 7 {
+		t.Fatal("op/ltime mismatch")
+	}
+	if !bytes.Equal(rec1.id, rec.id) || !bytes.Equal(rec1.prev, rec.prev) {
+		t.Fatal("id/prev mismatch")
+	}
+
+	if err := rec1.UnmarshalBinary(b[:9]); err != errInvalidJournalRecord {
+		t.Fatalf("should fail with='%v' got='%v'", errInvalidJournalRecord, err)
+	}
+}
+
+func Test_IndexStore_journalReplay(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 32)
+	id[0] = 'a'
+	if err = ki.Append(id, make([]byte, 32), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ki.SetMarker([]byte("marker")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash by closing bolt without flushing the open indexes
+	idxs.openIdxs.shutdown <- struct{}{}
+	<-idxs.openIdxs.stopped
+	idxs.db.Close()
+
+	idxs = NewIndexStore()
+	if err = idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err = idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+
+	if ki.Count() != 1 {
+		t.Fatal("should have 1 entry", ki.Count())
+	}
+	if !bytes.Equal(ki.Last(), id) {
+		t.Fatal("last id mismatch")
+	}
+	if string(ki.Marker()) != "marker" {
+		t.Fatal("wrong marker value")
+	}
+
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	idxs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(idxs.jbucket).Bucket([]byte("key")) != nil {
+			t.Error("journal should be truncated after flush")
+		}
+		return nil
+	})
+}
+
+func Test_KeylogIndex_Append_mismatch(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+
+	id := make([]byte, 32)
+	id[0] = 'a'
+	if err = ki.Append(id, make([]byte, 32), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected appends are neither journaled nor mark the index dirty
+	if err = ki.Append([]byte("b"), []byte("wrong"), 2); err != hexatype.ErrPreviousHash {
+		t.Fatal("should fail with previous hash mismatch", err)
+	}
+	if idxs.Stats().DirtyKeys != 0 {
+		t.Fatal("rejected append should leave the key clean")
+	}
+	idxs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(idxs.jbucket).Bucket([]byte("key")) != nil {
+			t.Error("rejected append should not be journaled")
+		}
+		return nil
+	})
+}
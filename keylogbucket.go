@@ -0,0 +1,345 @@
+package hexaboltdb
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+	"github.com/hexablock/log"
+)
+
+// Each key is stored as a nested bucket in the index bucket.  It holds a header
+// with the index minus its entries, a sub-bucket of entry ids keyed by their
+// position in the log so appends only write new rows, a sub-bucket mapping each
+// entry id back to its position and Lamport time and a sub-bucket of entry ids
+// keyed by Lamport time and position.  Entries written by older versions have
+// no Lamport time.
+var (
+	keylogHeaderKey  = []byte("h")
+	keylogEntriesKey = []byte("e")
+	keylogIDsKey     = []byte("i")
+	keylogLTimesKey  = []byte("t")
+)
+
+// marshalKeylogHeader marshals the index without its entry ids
+func marshalKeylogHeader(ukli *hexalog.UnsafeKeylogIndex) ([]byte, error) {
+	hdr := *ukli
+	hdr.Entries = nil
+	return proto.Marshal(&hdr)
+}
+
+// hasKeylog returns true if the key has a stored index
+func hasKeylog(bkt *bolt.Bucket, key []byte) bool {
+	return bkt.Bucket(key) != nil || bkt.Get(key) != nil
+}
+
+// writeKeylog writes the header and the entry ids with their Lamport times
+// starting at position from.  All stored ids at or after from are replaced.  A
+// zero or missing Lamport time is not indexed.
+func writeKeylog(bkt *bolt.Bucket, key, header []byte, from int, ids [][]byte, ltimes []uint64) error {
+	kb, err := bkt.CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	if err = kb.Put(keylogHeaderKey, header); err != nil {
+		return err
+	}
+	eb, err := kb.CreateBucketIfNotExists(keylogEntriesKey)
+	if err != nil {
+		return err
+	}
+	ib, err := kb.CreateBucketIfNotExists(keylogIDsKey)
+	if err != nil {
+		return err
+	}
+	tb, err := kb.CreateBucketIfNotExists(keylogLTimesKey)
+	if err != nil {
+		return err
+	}
+
+	// Deleting while iterating a cursor skips keys so collect them first
+	var stale, staleIDs [][]byte
+	c := eb.Cursor()
+	for k, v := c.Seek(uint64Bytes(uint64(from))); k != nil; k, v = c.Next() {
+		stale = append(stale, k)
+		staleIDs = append(staleIDs, v)
+	}
+	for i, k := range stale {
+		if v := ib.Get(staleIDs[i]); len(v) >= 16 {
+			if err = tb.Delete(ltimeKey(binary.BigEndian.Uint64(v[8:16]), k)); err != nil {
+				return err
+			}
+		}
+		if err = ib.Delete(staleIDs[i]); err != nil {
+			return err
+		}
+		if err = eb.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for i, id := range ids {
+		var ltime uint64
+		if i < len(ltimes) {
+			ltime = ltimes[i]
+		}
+
+		pos := uint64Bytes(uint64(from + i))
+		if err = eb.Put(pos, id); err != nil {
+			return err
+		}
+		if err = ib.Put(id, append(pos, uint64Bytes(ltime)...)); err != nil {
+			return err
+		}
+		if ltime == 0 {
+			continue
+		}
+		if err = tb.Put(ltimeKey(ltime, pos), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ltimeKey returns the Lamport time sub-bucket key ltime | pos
+func ltimeKey(ltime uint64, pos []byte) []byte {
+	return append(uint64Bytes(ltime), pos...)
+}
+
+// readKeylog reads the key's stored index along with the position of its first
+// entry id and its estimated memory size.  If tail is non-zero only the last
+// tail entry ids are read.  Indexes stored as a single value by older versions
+// are read in full.
+func readKeylog(bkt *bolt.Bucket, key []byte, tail int) (*hexalog.UnsafeKeylogIndex, int, int64, error) {
+	var ukli hexalog.UnsafeKeylogIndex
+
+	kb := bkt.Bucket(key)
+	if kb == nil {
+		data := bkt.Get(key)
+		if data == nil {
+			return nil, 0, 0, hexatype.ErrKeyNotFound
+		}
+		if err := proto.Unmarshal(data, &ukli); err != nil {
+			return nil, 0, 0, err
+		}
+		return &ukli, 0, int64(len(data)), nil
+	}
+
+	header := kb.Get(keylogHeaderKey)
+	if err := proto.Unmarshal(header, &ukli); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var (
+		base int
+		size = int64(len(header))
+	)
+	if eb := kb.Bucket(keylogEntriesKey); eb != nil {
+		c := eb.Cursor()
+		if k, _ := c.Last(); k != nil && tail > 0 {
+			if n := int(binary.BigEndian.Uint64(k)) + 1; n > tail {
+				base = n - tail
+			}
+		}
+		for k, v := c.Seek(uint64Bytes(uint64(base))); k != nil; k, v = c.Next() {
+			// Values are only valid for the life of the transaction
+			ukli.Entries = append(ukli.Entries, append([]byte{}, v...))
+			size += entrySize(v)
+		}
+	}
+
+	return &ukli, base, size, nil
+}
+
+// readKeylogRange returns the key's stored entry ids in positions [from, to)
+func readKeylogRange(db *DB, bucket, key []byte, from, to int) ([][]byte, error) {
+	ids := make([][]byte, 0, to-from)
+	err := db.View(func(tx *bolt.Tx) error {
+		eb := keylogBucket(tx, bucket, key, keylogEntriesKey)
+		if eb == nil {
+			return nil
+		}
+		c := eb.Cursor()
+		for k, v := c.Seek(uint64Bytes(uint64(from))); k != nil && len(ids) < to-from; k, v = c.Next() {
+			ids = append(ids, append([]byte{}, v...))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// keylogPosition returns the stored position of the entry id in the key's log
+// or -1 if it is not stored
+func keylogPosition(db *DB, bucket, key, id []byte) (int, error) {
+	pos := -1
+	err := db.View(func(tx *bolt.Tx) error {
+		if ib := keylogBucket(tx, bucket, key, keylogIDsKey); ib != nil {
+			if v := ib.Get(id); v != nil {
+				pos = int(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+	return pos, err
+}
+
+// seekKeylogLTime returns the stored entry id with the highest Lamport time at
+// or before ltime among the first n positions of the key's log.  It returns nil
+// if there is none
+func seekKeylogLTime(db *DB, bucket, key []byte, ltime uint64, n int) ([]byte, error) {
+	var id []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		tb := keylogBucket(tx, bucket, key, keylogLTimesKey)
+		if tb == nil {
+			return nil
+		}
+
+		// Position just past the last key at or before ltime
+		c := tb.Cursor()
+		var k, v []byte
+		if ltime == math.MaxUint64 {
+			k, v = c.Last()
+		} else if k, _ = c.Seek(ltimeKey(ltime+1, uint64Bytes(0))); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			if binary.BigEndian.Uint64(k[8:]) < uint64(n) {
+				id = append([]byte{}, v...)
+				break
+			}
+		}
+		return nil
+	})
+	return id, err
+}
+
+// keylogContains returns true if the entry id is stored in the key's log
+func keylogContains(bkt *bolt.Bucket, key, id []byte) bool {
+	if kb := bkt.Bucket(key); kb != nil {
+		if ib := kb.Bucket(keylogIDsKey); ib != nil {
+			return ib.Get(id) != nil
+		}
+	}
+	return false
+}
+
+// keylogBucket returns the named sub-bucket of the key's stored index if it
+// exists
+func keylogBucket(tx *bolt.Tx, bucket, key, name []byte) *bolt.Bucket {
+	if kb := tx.Bucket(bucket).Bucket(key); kb != nil {
+		return kb.Bucket(name)
+	}
+	return nil
+}
+
+// deleteKeylog removes the key's stored index.  It returns false if there was
+// nothing stored
+func deleteKeylog(bkt *bolt.Bucket, key []byte) (bool, error) {
+	err := bkt.DeleteBucket(key)
+	if err == bolt.ErrBucketNotFound {
+		if bkt.Get(key) == nil {
+			return false, nil
+		}
+		err = bkt.Delete(key)
+	}
+	return err == nil, err
+}
+
+// Bucket sequence set on the index bucket once all indexes stored by older
+// versions have been migrated
+const keylogsMigrated = 1
+
+// migrateKeylogs converts indexes stored as a single value by older versions to
+// the current layout.  Their markers are moved to the markers bucket.  Keys
+// are converted in batches to bound transaction size.  It is a no-op once the
+// bucket has been migrated.
+func migrateKeylogs(db *DB, bucket, mbucket []byte) error {
+	var (
+		total int
+		last  []byte
+	)
+	for {
+		var n int
+		err := db.Update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket(bucket)
+			mbkt := tx.Bucket(mbucket)
+			if bkt.Sequence() == keylogsMigrated {
+				return nil
+			}
+
+			var keys [][]byte
+			c := bkt.Cursor()
+			// Resume after the previous batch.  The last key has been
+			// converted so it is skipped
+			k, v := c.First()
+			if last != nil {
+				k, v = c.Seek(last)
+			}
+			for ; k != nil && len(keys) < maxFlushBatch; k, v = c.Next() {
+				if v != nil {
+					keys = append(keys, append([]byte{}, k...))
+				}
+			}
+
+			for _, key := range keys {
+				ukli, _, _, err := readKeylog(bkt, key, 0)
+				if err != nil {
+					return err
+				}
+				header, err := marshalKeylogHeader(ukli)
+				if err != nil {
+					return err
+				}
+				if err = bkt.Delete(key); err != nil {
+					return err
+				}
+				if err = writeKeylog(bkt, key, header, 0, ukli.Entries, nil); err != nil {
+					return err
+				}
+				if err = migrateMarker(mbkt, key, ukli.Marker); err != nil {
+					return err
+				}
+				db.track(tx, bucket, key)
+				db.track(tx, mbucket, key)
+			}
+
+			if n = len(keys); n > 0 {
+				last = keys[n-1]
+				return nil
+			}
+			return bkt.SetSequence(keylogsMigrated)
+		})
+
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+
+	if total > 0 {
+		log.Printf("[INFO] Migrated keylog indexes bucket=%s count=%d", bucket, total)
+	}
+	return nil
+}
+
+// migrateMarker adds a marker record for a marker stored in an index header by
+// older versions
+func migrateMarker(mbkt *bolt.Bucket, key, marker []byte) error {
+	if len(marker) == 0 || mbkt.Get(key) != nil {
+		return nil
+	}
+	value, err := newMarkerRecord(marker, 0).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return mbkt.Put(key, value)
+}
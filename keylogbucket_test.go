@@ -0,0 +1,324 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+)
+
+func Test_KeylogIndex_rows(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	key := []byte("key")
+	ki, err := idxs.NewKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+
+	ids := make([][]byte, 3)
+	prev := make([]byte, 32)
+	for i := range ids {
+		ids[i] = make([]byte, 32)
+		ids[i][0] = byte(i + 1)
+		if err = ki.Append(ids[i], prev, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+		prev = ids[i]
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := idxs.storedIDs(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 3 {
+		t.Fatal("should have 3 stored ids", len(stored))
+	}
+
+	// Rows removed by a rollback are dropped and replaced on the next flush
+	ki.Rollback(2)
+	ki.Rollback(1)
+	id := make([]byte, 32)
+	id[0] = 'z'
+	if err = ki.Append(id, ids[0], 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err = idxs.storedIDs(key); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatal("should have 2 stored ids", len(stored))
+	}
+	if !bytes.Equal(stored[0], ids[0]) || !bytes.Equal(stored[1], id) {
+		t.Fatal("stored ids mismatch")
+	}
+}
+
+func Test_IndexStore_migrate(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write an index the way older versions stored it
+	key := []byte("key")
+	id := make([]byte, 32)
+	id[0] = 'a'
+	ukli := hexalog.NewUnsafeKeylogIndex(key)
+	if err := ukli.Append(id, make([]byte, 32), 1); err != nil {
+		t.Fatal(err)
+	}
+	ukli.SetMarker([]byte("marker"))
+	data, _ := proto.Marshal(ukli)
+	err := idxs.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(idxs.bucket)
+		// Older versions did not mark the bucket as migrated
+		if err := bkt.SetSequence(0); err != nil {
+			return err
+		}
+		return bkt.Put(key, data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxs.Close()
+
+	idxs = NewIndexStore()
+	if err = idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	idxs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(idxs.bucket).Bucket(key) == nil {
+			t.Error("index should be migrated to a bucket")
+		}
+		if tx.Bucket(idxs.bucket).Sequence() != keylogsMigrated {
+			t.Error("bucket should be marked as migrated")
+		}
+		return nil
+	})
+	if idxs.Count() != 1 {
+		t.Fatal("should have 1 key", idxs.Count())
+	}
+
+	ki, err := idxs.GetKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+
+	if !bytes.Equal(ki.Last(), id) {
+		t.Fatal("last id mismatch")
+	}
+	if string(ki.Marker()) != "marker" {
+		t.Fatal("wrong marker value")
+	}
+}
+
+func Test_KeylogIndex_tail(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithKeylogTail(2))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("key")
+	ki, err := idxs.NewKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([][]byte, 6)
+	prev := make([]byte, 32)
+	for i := range ids {
+		ids[i] = make([]byte, 32)
+		ids[i][0] = byte(i + 1)
+		if err = ki.Append(ids[i], prev, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+		prev = ids[i]
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ki.Close()
+	idxs.Close()
+
+	idxs = NewIndexStore(WithKeylogTail(2))
+	if err = idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err = idxs.GetKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+
+	if ki.(*KeylogIndex).base != 4 {
+		t.Fatal("should only load the tail", ki.(*KeylogIndex).base)
+	}
+	if ki.Count() != 6 {
+		t.Fatal("should have 6 entries", ki.Count())
+	}
+	if !ki.Contains(ids[0]) || ki.Contains(make([]byte, 32)) {
+		t.Fatal("contains mismatch")
+	}
+
+	var got [][]byte
+	err = ki.Iter(ids[1], func(id []byte) error {
+		got = append(got, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 || !bytes.Equal(got[0], ids[1]) || !bytes.Equal(got[4], ids[5]) {
+		t.Fatal("iter mismatch", len(got))
+	}
+	if n := len(ki.Index().Entries); n != 6 {
+		t.Fatal("index should have all entries", n)
+	}
+
+	// Ids not in memory are read while iterating the store
+	err = idxs.Iter(func(k []byte, idx hexalog.KeylogIndex) error {
+		var n int
+		idx.Iter(nil, func(id []byte) error {
+			n++
+			return nil
+		})
+		if n != 6 {
+			t.Fatal("store iteration should see all entries", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolling back past the tail loads the preceding ids
+	if n, ok := ki.Rollback(5); !ok || n != 5 {
+		t.Fatal("rollback count mismatch", n, ok)
+	}
+	if n, ok := ki.Rollback(4); !ok || n != 4 {
+		t.Fatal("rollback count mismatch", n, ok)
+	}
+	if !bytes.Equal(ki.Last(), ids[3]) {
+		t.Fatal("last id mismatch")
+	}
+	if ki.Count() != 4 {
+		t.Fatal("should have 4 entries", ki.Count())
+	}
+	if err = ki.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := idxs.storedIDs(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 4 {
+		t.Fatal("should have 4 stored ids", len(stored))
+	}
+}
+
+func Test_KeylogIndex_EntryAt(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore(WithKeylogTail(2))
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ki, err := idxs.NewKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+	kli := ki.(*KeylogIndex)
+
+	ids := make([][]byte, 8)
+	prev := make([]byte, 32)
+	for i := range ids {
+		ids[i] = make([]byte, 32)
+		ids[i][0] = byte(i + 1)
+		if err = ki.Append(ids[i], prev, uint64(i+1)*10); err != nil {
+			t.Fatal(err)
+		}
+		prev = ids[i]
+		// Leave the last 2 unflushed
+		if i == 5 {
+			if err = ki.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, h := range []uint32{1, 5, 8} {
+		id, err := kli.EntryAt(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(id, ids[h-1]) {
+			t.Fatal("id mismatch at height", h)
+		}
+	}
+	for _, h := range []uint32{0, 9} {
+		if _, err = kli.EntryAt(h); err != hexatype.ErrEntryNotFound {
+			t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrEntryNotFound, err)
+		}
+	}
+
+	for lt, want := range map[uint64]int{35: 2, 75: 6, 1000: 7} {
+		id, err := kli.EntryAtLTime(lt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(id, ids[want]) {
+			t.Fatal("id mismatch at ltime", lt)
+		}
+	}
+	if _, err = kli.EntryAtLTime(5); err != hexatype.ErrEntryNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrEntryNotFound, err)
+	}
+
+	// Stored entries that were rolled back are not returned
+	ki.Rollback(70)
+	ki.Rollback(60)
+	ki.Rollback(50)
+	id, err := kli.EntryAtLTime(65)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, ids[4]) {
+		t.Fatal("should skip rolled back entry")
+	}
+}
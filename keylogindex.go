@@ -1,58 +1,197 @@
 package hexaboltdb
 
 import (
+	"bytes"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/golang/protobuf/proto"
 	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+	"github.com/hexablock/log"
+)
+
+var (
+	errIncompleteKeylog = errors.New("stored keylog entries missing")
+	errIndexRetired     = errors.New("KeylogIndex removed or force released")
 )
 
 // KeylogIndex implements a hexalog.KeylogIndex interface backed by rocks
 type KeylogIndex struct {
+	// Generation incremented on each mutation, the generation last flushed and
+	// the estimated size.  Accessed atomically and kept first for 64-bit
+	// alignment
+	gen  uint64
+	fgen uint64
+	// Estimated memory used by the index in bytes
+	size int64
+
+	// Key of the index.  Never changes so it is read without the lock
+	key []byte
 	mu  sync.RWMutex
 	idx *hexalog.UnsafeKeylogIndex
 	// Backend to flush data to
-	db     *bolt.DB
+	db     *DB
 	bucket []byte
+	// Journal bucket and the sequence of the last journaled mutation
+	jbucket []byte
+	jseq    uint64
+	// Serializes flushes so an older snapshot never overwrites a newer one
+	fmu sync.Mutex
+	// Set under the flush lock once the index is removed from bolt or replaced
+	// by a copy after a force release so a flush still holding it or a stale
+	// reference cannot write it
+	retired bool
+	// Number of leading entries known to be stored and the lowest entry count
+	// since the last snapshot, protected by mu.  Stored entries before the
+	// lower of the two match memory and the rest are written on the next flush
+	rows int
+	low  int
+	// Position of the first in-memory entry id, protected by mu, and the
+	// number of most recent ids to keep in memory.  Ids before base are read
+	// from bolt on demand.  Zero tail keeps all ids in memory
+	base int
+	tail int
+	// Lamport times of the in-memory entry ids, protected by mu.  Zero for ids
+	// read from bolt as their times are only needed once written
+	ltimes []uint64
+	// Markers bucket, the default marker time to live and the expiry of the
+	// current marker in unix nanoseconds, protected by mu.  Zero never expires
+	mbucket  []byte
+	mttl     time.Duration
+	mexpires int64
 	// Open index tracker used when closing the index
 	kh *openIndexes
 }
 
 // Key returns the key for the index
 func (idx *KeylogIndex) Key() []byte {
-	return idx.idx.Key
+	return idx.key
 }
 
-// Marker returns the marker value
+// Marker returns the marker value or nil if it has expired
 func (idx *KeylogIndex) Marker() []byte {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
+
+	if idx.mexpires > 0 && idx.mexpires <= time.Now().UnixNano() {
+		return nil
+	}
 	return idx.idx.Marker
 }
 
 // SetMarker sets the marker for the index.  It returns true if the marker is not part of
-// the index and was set.  This never returns an error as it is in-memory
+// the index and was set.  The marker is persisted before it is set and expires
+// after the configured marker TTL if any.  It only returns an error if the
+// marker could not be persisted
 func (idx *KeylogIndex) SetMarker(marker []byte) (bool, error) {
+	return idx.setMarker(marker, idx.mttl)
+}
+
+// setMarker persists and sets the marker with the given time to live.  Zero ttl
+// never expires
+func (idx *KeylogIndex) setMarker(marker []byte, ttl time.Duration) (bool, error) {
 	idx.mu.Lock()
-	ok := idx.idx.SetMarker(marker)
-	idx.mu.Unlock()
-	return ok, nil
+	defer idx.mu.Unlock()
+
+	if idx.contains(marker) {
+		return false, nil
+	}
+
+	rec := newMarkerRecord(marker, ttl)
+	if err := writeMarker(idx.db, idx.mbucket, idx.Key(), rec); err != nil {
+		return false, err
+	}
+	idx.mexpires = rec.expires
+	// Written with the index header on the next flush
+	atomic.AddUint64(&idx.gen, 1)
+
+	return idx.idx.SetMarker(marker), nil
 }
 
-// Append appends the id to the index checking the previous hash.
+// Append appends the id to the index checking the previous hash.  The append is
+// journaled before it is applied so appends with a mismatched previous hash are
+// rejected first.  Appending the marked id clears the marker.
 func (idx *KeylogIndex) Append(id, prev []byte, ltime uint64) error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	return idx.idx.Append(id, prev, ltime)
+	if err := idx.checkPrev(prev); err != nil {
+		return err
+	}
+
+	rec := &journalRecord{op: journalOpAppend, ltime: ltime, id: id, prev: prev}
+	if err := idx.journal(rec); err != nil {
+		return err
+	}
+
+	marked := idx.marks(id)
+	err := idx.idx.Append(id, prev, ltime)
+	if err == nil {
+		idx.ltimes = append(idx.ltimes, ltime)
+		atomic.AddInt64(&idx.size, entrySize(id))
+		if marked {
+			// A stale marker record is dropped on the next open
+			if er := deleteMarker(idx.db, idx.mbucket, idx.Key()); er != nil {
+				log.Printf("[ERROR] Failed to delete marker key=%s error='%v'", idx.Key(), er)
+			}
+			idx.clearMarker()
+		}
+	}
+	return err
+}
+
+// checkPrev returns an error if prev is not the last entry id.  Any prev is
+// accepted by an empty index.  The caller must hold the index lock
+func (idx *KeylogIndex) checkPrev(prev []byte) error {
+	if last := idx.idx.Last(); last != nil && !bytes.Equal(last, prev) {
+		return hexatype.ErrPreviousHash
+	}
+	return nil
+}
+
+// marks returns true if id is the marker.  The caller must hold the index lock
+func (idx *KeylogIndex) marks(id []byte) bool {
+	return len(idx.idx.Marker) > 0 && bytes.Equal(idx.idx.Marker, id)
+}
+
+// clearMarker clears the in-memory marker.  The caller must hold the index
+// write lock
+func (idx *KeylogIndex) clearMarker() {
+	idx.idx.Marker = nil
+	idx.mexpires = 0
 }
 
-// Rollback safely removes the last entry id
+// Rollback safely removes the last entry id returning the entry count.  A
+// failure to journal the rollback is logged as the rollback itself cannot fail
 func (idx *KeylogIndex) Rollback(ltime uint64) (int, bool) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
-	return idx.idx.Rollback(ltime)
+
+	if err := idx.journal(&journalRecord{op: journalOpRollback, ltime: ltime}); err != nil {
+		log.Printf("[ERROR] Failed to journal rollback key=%s error='%v'", idx.Key(), err)
+	}
+
+	// Keep the previous id in memory so the new last id is known
+	if idx.base > 0 && len(idx.idx.Entries) <= 1 {
+		if err := idx.loadPage(); err != nil {
+			log.Printf("[ERROR] Failed to load index entries key=%s error='%v'", idx.Key(), err)
+		}
+	}
+
+	last := idx.idx.Last()
+	n, ok := idx.idx.Rollback(ltime)
+	if ok {
+		idx.ltimes = idx.ltimes[:len(idx.idx.Entries)]
+		atomic.AddInt64(&idx.size, -entrySize(last))
+		if c := idx.base + len(idx.idx.Entries); c < idx.low {
+			idx.low = c
+		}
+	}
+	// Ids before base are not held in memory
+	return idx.base + n, ok
 }
 
 // Last safely returns the last entry id
@@ -62,25 +201,80 @@ func (idx *KeylogIndex) Last() []byte {
 	return idx.idx.Last()
 }
 
-// Contains safely returns if the entry id is in the index
+// Contains safely returns if the entry id is in the index.  Ids not in memory
+// are looked up in bolt
 func (idx *KeylogIndex) Contains(id []byte) bool {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
-	return idx.idx.Contains(id)
+	return idx.contains(id)
+}
+
+// contains returns if the entry id is in the index.  The caller must hold the
+// index lock
+func (idx *KeylogIndex) contains(id []byte) bool {
+	if idx.idx.Contains(id) {
+		return true
+	} else if idx.base == 0 {
+		return false
+	}
+
+	pos, err := keylogPosition(idx.db, idx.bucket, idx.Key(), id)
+	if err != nil {
+		log.Printf("[ERROR] Failed to look up index entry key=%s error='%v'", idx.Key(), err)
+		return false
+	}
+	// Stored ids at or after base have been rolled back if not in memory
+	return pos >= 0 && pos < idx.base
 }
 
-// Iter iterates over each entry id in the index
+// Iter iterates over each entry id in the index.  Ids not in memory are read
+// from bolt a page at a time
 func (idx *KeylogIndex) Iter(seek []byte, cb func(id []byte) error) error {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
-	return idx.idx.Iter(seek, cb)
+
+	if idx.base == 0 || (seek != nil && idx.idx.Contains(seek)) {
+		return idx.idx.Iter(seek, cb)
+	}
+
+	var pos int
+	if seek != nil {
+		p, err := keylogPosition(idx.db, idx.bucket, idx.Key(), seek)
+		if err != nil {
+			return err
+		}
+		if p < 0 || p >= idx.base {
+			return hexatype.ErrEntryNotFound
+		}
+		pos = p
+	}
+
+	// Stored ids before base cannot change while the read lock is held
+	for pos < idx.base {
+		end := pos + idx.tail
+		if end > idx.base {
+			end = idx.base
+		}
+		ids, err := readKeylogRange(idx.db, idx.bucket, idx.Key(), pos, end)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err = cb(id); err != nil {
+				return err
+			}
+		}
+		pos = end
+	}
+
+	return idx.idx.Iter(nil, cb)
 }
 
 // Count returns the number of entries in the index
 func (idx *KeylogIndex) Count() int {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
-	return idx.idx.Count()
+	return idx.base + idx.idx.Count()
 }
 
 // Height returns the height of the log in a thread safe way
@@ -90,29 +284,91 @@ func (idx *KeylogIndex) Height() uint32 {
 	return idx.idx.Height
 }
 
+// EntryAt returns the id of the entry at the given height.  The first entry is
+// at height 1.  Ids not in memory are read from bolt
+func (idx *KeylogIndex) EntryAt(height uint32) ([]byte, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	pos := int(height) - 1
+	if pos < 0 || pos >= idx.base+len(idx.idx.Entries) {
+		return nil, hexatype.ErrEntryNotFound
+	} else if pos >= idx.base {
+		return idx.idx.Entries[pos-idx.base], nil
+	}
+
+	ids, err := readKeylogRange(idx.db, idx.bucket, idx.Key(), pos, pos+1)
+	if err != nil {
+		return nil, err
+	} else if len(ids) == 0 {
+		return nil, errIncompleteKeylog
+	}
+	return ids[0], nil
+}
+
+// EntryAtLTime returns the id of the last entry with a Lamport time at or before
+// ltime.  Lamport times increase along a keylog so entries not yet flushed are
+// checked first followed by those stored in bolt.  Entries stored by older
+// versions have no Lamport time and are never returned.
+func (idx *KeylogIndex) EntryAtLTime(ltime uint64) ([]byte, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Stored entries at or after this position are stale
+	stored := idx.rows
+	if idx.low < stored {
+		stored = idx.low
+	}
+
+	for i := len(idx.ltimes) - 1; i >= 0 && idx.base+i >= stored; i-- {
+		if lt := idx.ltimes[i]; lt > 0 && lt <= ltime {
+			return idx.idx.Entries[i], nil
+		}
+	}
+
+	id, err := seekKeylogLTime(idx.db, idx.bucket, idx.Key(), ltime, stored)
+	if err == nil && id == nil {
+		err = hexatype.ErrEntryNotFound
+	}
+	return id, err
+}
+
 // Index returns the KeylogIndex index struct.  It is meant be used as readonly
-// point in time.
+// point in time.  Entry ids not in memory are read from bolt
 func (idx *KeylogIndex) Index() hexalog.UnsafeKeylogIndex {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
-	return *idx.idx
+
+	ukli := *idx.idx
+	if idx.base > 0 {
+		ids, err := readKeylogRange(idx.db, idx.bucket, idx.Key(), 0, idx.base)
+		if err != nil {
+			log.Printf("[ERROR] Failed to read index entries key=%s error='%v'", idx.Key(), err)
+		}
+		ukli.Entries = append(ids, idx.idx.Entries...)
+	}
+	return ukli
 }
 
-// Flush writes the data out to rocks
+// Flush writes the data out to bolt and truncates the journaled mutations
+// included in the written data
 func (idx *KeylogIndex) Flush() error {
-	idx.mu.RLock()
-	value, err := proto.Marshal(idx.idx)
-	idx.mu.RUnlock()
+	idx.fmu.Lock()
+	defer idx.fmu.Unlock()
 
+	snap, err := idx.snapshot()
 	if err == nil {
 
 		err = idx.db.Update(func(tx *bolt.Tx) error {
-			bkt := tx.Bucket(idx.bucket)
-			return bkt.Put(idx.Key(), value)
+			return idx.write(tx, snap)
 		})
 
 	}
 
+	if err == nil {
+		snap.flushed()
+	}
+
 	// if err == nil {
 	// 	log.Printf("[DEBUG] Flushed index key=%s", idx.Key())
 	// }
@@ -123,5 +379,213 @@ func (idx *KeylogIndex) Flush() error {
 // Close closes the index by calling close on the open handle manager.  It is
 // does not flush the data rather it is flushed at an interval for performance
 func (idx *KeylogIndex) Close() error {
-	return idx.kh.close(idx.Key())
+	return idx.kh.close(idx)
+}
+
+// clone retires the index and returns a copy of it to take its place.  The
+// copy starts out with the same unflushed changes.
+func (idx *KeylogIndex) clone() *KeylogIndex {
+	idx.fmu.Lock()
+	defer idx.fmu.Unlock()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	ukli := *idx.idx
+	ukli.Entries = append([][]byte{}, idx.idx.Entries...)
+	idx.retired = true
+
+	return &KeylogIndex{
+		gen:      atomic.LoadUint64(&idx.gen),
+		fgen:     atomic.LoadUint64(&idx.fgen),
+		size:     atomic.LoadInt64(&idx.size),
+		key:      idx.key,
+		idx:      &ukli,
+		db:       idx.db,
+		bucket:   idx.bucket,
+		jbucket:  idx.jbucket,
+		jseq:     idx.jseq,
+		rows:     idx.rows,
+		low:      idx.low,
+		base:     idx.base,
+		tail:     idx.tail,
+		ltimes:   append([]uint64{}, idx.ltimes...),
+		mbucket:  idx.mbucket,
+		mttl:     idx.mttl,
+		mexpires: idx.mexpires,
+		kh:       idx.kh,
+	}
+}
+
+// indexSnapshot is a marshalled point in time copy of a KeylogIndex holding
+// only the entries changed since the last write
+type indexSnapshot struct {
+	idx    *KeylogIndex
+	header []byte
+	// Entry ids and their Lamport times from position from onwards and the
+	// total entry count
+	from   int
+	ids    [][]byte
+	ltimes []uint64
+	n      int
+	// Last journal sequence and generation included in the value
+	jseq uint64
+	gen  uint64
+}
+
+// flushed marks the snapshot as written.  The caller must hold the flush lock
+func (snap *indexSnapshot) flushed() {
+	snap.idx.mu.Lock()
+	snap.written()
+	snap.idx.mu.Unlock()
+}
+
+// written marks the snapshot as written and drops ids beyond the tail from
+// memory.  The caller must hold both the flush lock and the index write lock
+func (snap *indexSnapshot) written() {
+	snap.idx.rows = snap.n
+	snap.idx.trim()
+	atomic.StoreUint64(&snap.idx.fgen, snap.gen)
+}
+
+// snapshot marshals the index.  The caller must hold the flush lock until the
+// snapshot is written
+func (idx *KeylogIndex) snapshot() (*indexSnapshot, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	snap, err := idx.newSnapshot(idx.idx)
+	if err == nil {
+		// Stored rows before from are left untouched whether or not the
+		// snapshot is written.  Rollbacks from here on are tracked anew
+		idx.rows = snap.from
+		idx.low = snap.n
+	}
+	return snap, err
+}
+
+// newSnapshot marshals the header of ukli along with the in-memory entries not
+// yet stored.  The caller must hold both the flush lock and the index lock
+func (idx *KeylogIndex) newSnapshot(ukli *hexalog.UnsafeKeylogIndex) (*indexSnapshot, error) {
+	header, err := marshalKeylogHeader(ukli)
+	if err != nil {
+		return nil, err
+	}
+
+	from := idx.rows
+	if idx.low < from {
+		from = idx.low
+	}
+
+	return &indexSnapshot{
+		idx:    idx,
+		header: header,
+		from:   from,
+		// Copied as a rollback followed by an append reuses the backing array
+		ids:    append([][]byte{}, idx.idx.Entries[from-idx.base:]...),
+		ltimes: append([]uint64{}, idx.ltimes[from-idx.base:]...),
+		n:      idx.base + len(idx.idx.Entries),
+		jseq:   idx.jseq,
+		gen:    atomic.LoadUint64(&idx.gen),
+	}, nil
+}
+
+// trim drops stored entry ids beyond the tail from memory.  Ids are dropped
+// once twice the tail is held to avoid copying on every flush.  The caller must
+// hold the index write lock
+func (idx *KeylogIndex) trim() {
+	if idx.tail <= 0 || len(idx.idx.Entries) < 2*idx.tail {
+		return
+	}
+
+	// Only ids that are stored and not awaiting a rewrite can be dropped
+	n := len(idx.idx.Entries) - idx.tail
+	if s := idx.rows - idx.base; s < n {
+		n = s
+	}
+	if s := idx.low - idx.base; s < n {
+		n = s
+	}
+	if n <= 0 {
+		return
+	}
+
+	var freed int64
+	for _, id := range idx.idx.Entries[:n] {
+		freed += entrySize(id)
+	}
+	idx.idx.Entries = append([][]byte{}, idx.idx.Entries[n:]...)
+	idx.ltimes = append([]uint64{}, idx.ltimes[n:]...)
+	idx.base += n
+	atomic.AddInt64(&idx.size, -freed)
+}
+
+// loadPage reads the page of stored entry ids preceding base into memory.  The
+// caller must hold the index write lock
+func (idx *KeylogIndex) loadPage() error {
+	from := idx.base - idx.tail
+	if from < 0 {
+		from = 0
+	}
+
+	ids, err := readKeylogRange(idx.db, idx.bucket, idx.Key(), from, idx.base)
+	if err != nil {
+		return err
+	}
+	if len(ids) != idx.base-from {
+		return errIncompleteKeylog
+	}
+
+	var size int64
+	for _, id := range ids {
+		size += entrySize(id)
+	}
+	idx.idx.Entries = append(ids, idx.idx.Entries...)
+	idx.ltimes = append(make([]uint64, len(ids)), idx.ltimes...)
+	idx.base = from
+	atomic.AddInt64(&idx.size, size)
+	return nil
+}
+
+// memSize returns the estimated memory used by the index in bytes
+func (idx *KeylogIndex) memSize() int64 {
+	return atomic.LoadInt64(&idx.size)
+}
+
+// entrySize is the estimated memory used by an entry id in the index including
+// its slice header
+func entrySize(id []byte) int64 {
+	return int64(len(id)) + 24
+}
+
+// dirty returns true if the index has changed since it was last flushed
+func (idx *KeylogIndex) dirty() bool {
+	return atomic.LoadUint64(&idx.gen) != atomic.LoadUint64(&idx.fgen)
+}
+
+// write writes the snapshot and truncates the journal up to and including the
+// snapshot sequence within the transaction.  A retired index is not written.
+// The caller must hold the flush lock
+func (idx *KeylogIndex) write(tx *bolt.Tx, snap *indexSnapshot) error {
+	if idx.retired {
+		return errIndexRetired
+	}
+	err := writeKeylog(tx.Bucket(idx.bucket), idx.Key(), snap.header, snap.from, snap.ids, snap.ltimes)
+	if err != nil {
+		return err
+	}
+	idx.db.track(tx, idx.bucket, idx.Key())
+	idx.db.track(tx, idx.jbucket, idx.Key())
+	return truncateJournal(tx.Bucket(idx.jbucket), idx.Key(), snap.jseq)
+}
+
+// journal writes the mutation to the journal marking the index dirty.  The
+// caller must hold the write lock
+func (idx *KeylogIndex) journal(rec *journalRecord) error {
+	seq, err := writeJournal(idx.db, idx.jbucket, idx.Key(), rec)
+	if err == nil {
+		idx.jseq = seq
+		// Anything journaled needs a flush to truncate it
+		atomic.AddUint64(&idx.gen, 1)
+	}
+	return err
 }
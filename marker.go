@@ -0,0 +1,212 @@
+package hexaboltdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hexablock/hexalog"
+)
+
+var errInvalidMarkerRecord = errors.New("invalid marker record")
+
+// MarkerInfo describes an outstanding marker on a key, i.e. an entry the key is
+// waiting on
+type MarkerInfo struct {
+	Key    []byte
+	Marker []byte
+	// Time the marker was set
+	Created time.Time
+	// Time the marker expires.  Zero if it never expires
+	Expires time.Time
+}
+
+// markerRecord is a marker as persisted in the markers bucket.  Times are unix
+// nanoseconds
+type markerRecord struct {
+	marker  []byte
+	created int64
+	expires int64
+}
+
+func newMarkerRecord(marker []byte, ttl time.Duration) *markerRecord {
+	now := time.Now()
+	rec := &markerRecord{marker: marker, created: now.UnixNano()}
+	if ttl > 0 {
+		rec.expires = now.Add(ttl).UnixNano()
+	}
+	return rec
+}
+
+// MarshalBinary encodes the record as created | expires | marker
+func (rec *markerRecord) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 16+len(rec.marker))
+	binary.BigEndian.PutUint64(buf[:8], uint64(rec.created))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(rec.expires))
+	copy(buf[16:], rec.marker)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a record encoded with MarshalBinary
+func (rec *markerRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 16 {
+		return errInvalidMarkerRecord
+	}
+	rec.created = int64(binary.BigEndian.Uint64(b[:8]))
+	rec.expires = int64(binary.BigEndian.Uint64(b[8:16]))
+	rec.marker = append([]byte{}, b[16:]...)
+	return nil
+}
+
+// expired returns true if the marker has expired as of now
+func (rec *markerRecord) expired(now int64) bool {
+	return rec.expires > 0 && rec.expires <= now
+}
+
+func (rec *markerRecord) info(key []byte) MarkerInfo {
+	mi := MarkerInfo{
+		Key:     append([]byte{}, key...),
+		Marker:  rec.marker,
+		Created: time.Unix(0, rec.created),
+	}
+	if rec.expires > 0 {
+		mi.Expires = time.Unix(0, rec.expires)
+	}
+	return mi
+}
+
+// readMarker returns the key's marker record or nil if it has none or it has
+// expired
+func readMarker(bkt *bolt.Bucket, key []byte) (*markerRecord, error) {
+	v := bkt.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+
+	var rec markerRecord
+	if err := rec.UnmarshalBinary(v); err != nil {
+		return nil, err
+	}
+	if rec.expired(time.Now().UnixNano()) {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// writeMarker persists the key's marker record
+func writeMarker(db *DB, bucket, key []byte, rec *markerRecord) error {
+	value, err := rec.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		db.track(tx, bucket, key)
+		return tx.Bucket(bucket).Put(key, value)
+	})
+}
+
+// deleteMarker removes the key's marker record
+func deleteMarker(db *DB, bucket, key []byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		db.track(tx, bucket, key)
+		return tx.Bucket(bucket).Delete(key)
+	})
+}
+
+// MarkKeyTTL sets a marker on a key that expires after ttl.  Zero ttl never
+// expires.  If the key does not exist a new one is created.  It returns the
+// KeylogIndex or an error.
+func (store *IndexStore) MarkKeyTTL(key, marker []byte, ttl time.Duration) (hexalog.KeylogIndex, error) {
+	kli, _, err := store.getOrCreateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = kli.setMarker(marker, ttl)
+
+	return kli, err
+}
+
+// Markers returns all keys with an outstanding marker.  These are keys waiting
+// on an entry that has not been appended yet.  Expired markers are not
+// included.
+func (store *IndexStore) Markers() ([]MarkerInfo, error) {
+	var (
+		now     = time.Now().UnixNano()
+		markers []MarkerInfo
+	)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(store.mbucket).ForEach(func(k, v []byte) error {
+			var rec markerRecord
+			if err := rec.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			if !rec.expired(now) {
+				markers = append(markers, rec.info(k))
+			}
+			return nil
+		})
+	})
+
+	return markers, err
+}
+
+// reloadMarkers removes expired markers along with those whose entry has been
+// appended.  Keys created only to hold a marker that were never flushed are
+// restored.
+func (store *IndexStore) reloadMarkers() error {
+	now := time.Now().UnixNano()
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(store.bucket)
+		mbkt := tx.Bucket(store.mbucket)
+
+		var (
+			stale   [][]byte
+			missing [][]byte
+			recs    []*markerRecord
+		)
+		err := mbkt.ForEach(func(k, v []byte) error {
+			var rec markerRecord
+			if err := rec.UnmarshalBinary(v); err != nil {
+				return err
+			}
+
+			key := append([]byte{}, k...)
+			if rec.expired(now) || keylogContains(bkt, key, rec.marker) {
+				stale = append(stale, key)
+			} else if !hasKeylog(bkt, key) {
+				missing = append(missing, key)
+				recs = append(recs, &rec)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range stale {
+			if err = mbkt.Delete(key); err != nil {
+				return err
+			}
+			store.db.track(tx, store.mbucket, key)
+		}
+
+		for i, key := range missing {
+			ukli := hexalog.NewUnsafeKeylogIndex(key)
+			ukli.SetMarker(recs[i].marker)
+			header, err := marshalKeylogHeader(ukli)
+			if err != nil {
+				return err
+			}
+			if err = writeKeylog(bkt, key, header, 0, nil, nil); err != nil {
+				return err
+			}
+			store.db.track(tx, store.bucket, key)
+		}
+
+		return nil
+	})
+}
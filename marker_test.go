@@ -0,0 +1,104 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_markerRecord(t *testing.T) {
+	rec := newMarkerRecord([]byte("marker"), time.Minute)
+	b, _ := rec.MarshalBinary()
+
+	var rec1 markerRecord
+	if err := rec1.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec1.marker, rec.marker) || rec1.created != rec.created || rec1.expires != rec.expires {
+		t.Fatal("record mismatch")
+	}
+	if rec1.expired(time.Now().UnixNano()) {
+		t.Fatal("should not be expired")
+	}
+
+	if err := rec1.UnmarshalBinary(b[:15]); err != errInvalidMarkerRecord {
+		t.Fatalf("should fail with='%v' got='%v'", errInvalidMarkerRecord, err)
+	}
+}
+
+func Test_IndexStore_Markers(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	idxs := NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	marker := make([]byte, 32)
+	marker[0] = 'm'
+	for key, ttl := range map[string]time.Duration{"key1": time.Hour, "key2": 0, "key3": time.Nanosecond} {
+		ki, err := idxs.MarkKeyTTL([]byte(key), marker, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ki.Close()
+	}
+
+	// Simulate a crash by closing bolt without flushing the open indexes
+	idxs.openIdxs.shutdown <- struct{}{}
+	<-idxs.openIdxs.stopped
+	idxs.db.Close()
+
+	idxs = NewIndexStore()
+	if err := idxs.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	markers, err := idxs.Markers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(markers) != 2 {
+		t.Fatal("should have 2 markers", len(markers))
+	}
+	for _, mi := range markers {
+		if !bytes.Equal(mi.Marker, marker) {
+			t.Fatal("marker mismatch")
+		}
+		if string(mi.Key) == "key1" && mi.Expires.IsZero() {
+			t.Fatal("key1 marker should expire")
+		}
+	}
+	idxs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(idxs.mbucket).Get([]byte("key3")) != nil {
+			t.Error("expired marker should be removed on open")
+		}
+		return nil
+	})
+
+	ki, err := idxs.GetKey([]byte("key2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ki.Close()
+	if !bytes.Equal(ki.Marker(), marker) {
+		t.Fatal("marker should be reloaded")
+	}
+
+	// Appending the marked entry clears the marker
+	if err = ki.Append(marker, make([]byte, 32), 1); err != nil {
+		t.Fatal(err)
+	}
+	if ki.Marker() != nil {
+		t.Fatal("marker should be cleared")
+	}
+	if markers, _ = idxs.Markers(); len(markers) != 1 {
+		t.Fatal("should have 1 marker", len(markers))
+	}
+}
@@ -0,0 +1,191 @@
+package hexaboltdb
+
+import (
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Option sets a configuration option on a store.  Options not applicable to a
+// store are ignored by it.
+type Option func(*config)
+
+// config holds the configuration shared by all stores
+type config struct {
+	// Bolt options.  This is a copy so bolt.DefaultOptions is never modified
+	boltOpt bolt.Options
+	// Skip fsync after each commit
+	noSync bool
+	// Group commit limits.  Zero uses the bolt defaults
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+	// DB file mode
+	mode os.FileMode
+	// DB filename relative to the data directory
+	filename string
+	// Bucket holding the store data
+	bucket []byte
+	// Interval for the index flush loop
+	flushInterval time.Duration
+	// Time to wait after an index was last used before flushing it
+	flushWait time.Duration
+	// Limits on open keylog indexes.  Zero means no limit
+	maxOpenKeys    int
+	maxIndexMemory int64
+	// Threshold after which held handles are logged.  Zero disables
+	handleDebug time.Duration
+	// Number of most recent entry ids kept in memory per keylog index.  Zero
+	// keeps all of them
+	keylogTail int
+	// Default time to live of keylog index markers.  Zero never expires
+	markerTTL time.Duration
+}
+
+func newConfig(filename, bucket string, opts []Option) *config {
+	conf := &config{
+		boltOpt:       *bolt.DefaultOptions,
+		mode:          0600,
+		filename:      filename,
+		bucket:        []byte(bucket),
+		flushInterval: 60 * time.Second,
+		flushWait:     15 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	return conf
+}
+
+// WithTimeout sets the amount of time to wait to obtain the bolt file lock
+func WithTimeout(timeout time.Duration) Option {
+	return func(conf *config) {
+		conf.boltOpt.Timeout = timeout
+	}
+}
+
+// WithNoSync skips fsync after each commit.  This is unsafe and should only be
+// used when data loss on a crash is acceptable
+func WithNoSync(noSync bool) Option {
+	return func(conf *config) {
+		conf.noSync = noSync
+	}
+}
+
+// WithMaxBatchSize sets the maximum number of concurrent writes coalesced into
+// a single transaction
+func WithMaxBatchSize(size int) Option {
+	return func(conf *config) {
+		conf.maxBatchSize = size
+	}
+}
+
+// WithMaxBatchDelay sets the maximum time to wait for concurrent writes to be
+// coalesced before committing a transaction
+func WithMaxBatchDelay(delay time.Duration) Option {
+	return func(conf *config) {
+		conf.maxBatchDelay = delay
+	}
+}
+
+// WithInitialMmapSize sets the initial mmap size of the bolt database
+func WithInitialMmapSize(size int) Option {
+	return func(conf *config) {
+		conf.boltOpt.InitialMmapSize = size
+	}
+}
+
+// WithReadOnly opens the bolt database in read-only mode
+func WithReadOnly(readOnly bool) Option {
+	return func(conf *config) {
+		conf.boltOpt.ReadOnly = readOnly
+	}
+}
+
+// WithNoGrowSync sets the bolt NoGrowSync flag
+func WithNoGrowSync(noGrowSync bool) Option {
+	return func(conf *config) {
+		conf.boltOpt.NoGrowSync = noGrowSync
+	}
+}
+
+// WithFileMode sets the file mode used when creating the database file.  The
+// default is 0600
+func WithFileMode(mode os.FileMode) Option {
+	return func(conf *config) {
+		conf.mode = mode
+	}
+}
+
+// WithFilename sets the database filename within the data directory
+func WithFilename(filename string) Option {
+	return func(conf *config) {
+		conf.filename = filename
+	}
+}
+
+// WithBucket sets the name of the bucket the store keeps its data in
+func WithBucket(bucket string) Option {
+	return func(conf *config) {
+		conf.bucket = []byte(bucket)
+	}
+}
+
+// WithFlushInterval sets the interval at which open keylog indexes are checked
+// for flushing
+func WithFlushInterval(interval time.Duration) Option {
+	return func(conf *config) {
+		conf.flushInterval = interval
+	}
+}
+
+// WithFlushWait sets the time to wait after a keylog index was last used
+// before it is flushed
+func WithFlushWait(wait time.Duration) Option {
+	return func(conf *config) {
+		conf.flushWait = wait
+	}
+}
+
+// WithMaxOpenKeys limits the number of keylog indexes kept in memory.  The
+// least recently used idle indexes are flushed and evicted when over the limit
+func WithMaxOpenKeys(n int) Option {
+	return func(conf *config) {
+		conf.maxOpenKeys = n
+	}
+}
+
+// WithMaxIndexMemory limits the estimated memory in bytes used by the keylog
+// indexes kept in memory.  The least recently used idle indexes are flushed
+// and evicted when over the limit
+func WithMaxIndexMemory(bytes int64) Option {
+	return func(conf *config) {
+		conf.maxIndexMemory = bytes
+	}
+}
+
+// WithHandleDebug records the call stack of each keylog index acquire and logs
+// handles referenced for longer than the threshold on each flush interval.
+// Recording stacks is expensive and meant for tracking down handle leaks
+func WithHandleDebug(threshold time.Duration) Option {
+	return func(conf *config) {
+		conf.handleDebug = threshold
+	}
+}
+
+// WithKeylogTail keeps only the n most recent entry ids of each keylog index in
+// memory.  Older ids are read from bolt on demand when iterating or checking
+// for an id.  Zero, the default, keeps entire indexes in memory
+func WithKeylogTail(n int) Option {
+	return func(conf *config) {
+		conf.keylogTail = n
+	}
+}
+
+// WithMarkerTTL sets the default time after which markers set on keylog indexes
+// expire.  Zero, the default, never expires markers
+func WithMarkerTTL(ttl time.Duration) Option {
+	return func(conf *config) {
+		conf.markerTTL = ttl
+	}
+}
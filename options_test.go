@@ -0,0 +1,59 @@
+package hexaboltdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func Test_Options(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	store := NewEntryStore(
+		WithFilename("test.db"),
+		WithBucket("test"),
+		WithTimeout(time.Second),
+		WithNoSync(true),
+	)
+	if bolt.DefaultOptions.Timeout != 0 {
+		t.Fatal("default bolt options should not be modified")
+	}
+
+	if err := store.Open(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if !store.db.cur.db.NoSync {
+		t.Fatal("NoSync should be set")
+	}
+
+	fi, err := os.Stat(filepath.Join(tmpdir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("wrong file mode %v", fi.Mode().Perm())
+	}
+
+	store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("test")) == nil {
+			t.Error("bucket not created")
+		}
+		return nil
+	})
+
+	idxs := NewIndexStore(WithFlushInterval(time.Second), WithFlushWait(time.Millisecond))
+	defer idxs.openIdxs.closeAll()
+	if idxs.openIdxs.flushInt != time.Second || idxs.openIdxs.flushWait != time.Millisecond {
+		t.Fatal("flush timings not set")
+	}
+	if string(idxs.jbucket) != "index.journal" {
+		t.Fatal("wrong journal bucket", string(idxs.jbucket))
+	}
+}
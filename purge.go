@@ -0,0 +1,108 @@
+package hexaboltdb
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// PurgeResult is a summary of a purged key
+type PurgeResult struct {
+	Key []byte
+	// Number of entries deleted from the EntryStore
+	Deleted int
+	// Number of entry ids in the index that were not in the EntryStore
+	Missing int
+}
+
+// PurgeKey removes the key's index along with all entries it references from
+// the EntryStore.  When both stores share a DB everything is removed in a
+// single transaction, otherwise the entries are deleted before the index.  The
+// index must not have any open handles.
+func (store *IndexStore) PurgeKey(key []byte, entries *EntryStore) (*PurgeResult, error) {
+	// Take the index out of the open handles so unflushed ids are included.
+	// The key cannot be opened until the purge is done so a handle reading the
+	// index from bolt cannot write it back
+	kli, err := store.openIdxs.reserve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids [][]byte
+	if kli != nil {
+		kli.Iter(nil, func(id []byte) error {
+			ids = append(ids, id)
+			return nil
+		})
+	} else if ids, err = store.storedIDs(key); err != nil {
+		store.openIdxs.unreserve(key, nil)
+		return nil, err
+	}
+
+	if kli != nil {
+		// Wait for a flush already holding the index
+		kli.fmu.Lock()
+		defer kli.fmu.Unlock()
+	}
+
+	result := &PurgeResult{Key: key}
+
+	if entries.db == store.db {
+		err = store.db.Update(func(tx *bolt.Tx) error {
+			if er := purgeEntries(tx, entries, ids, result); er != nil {
+				return er
+			}
+			return store.removeIndex(tx, key, kli != nil)
+		})
+	} else {
+		err = entries.db.Update(func(tx *bolt.Tx) error {
+			return purgeEntries(tx, entries, ids, result)
+		})
+		if err == nil {
+			err = store.db.Update(func(tx *bolt.Tx) error {
+				return store.removeIndex(tx, key, kli != nil)
+			})
+		}
+	}
+
+	if err != nil {
+		// Put the index back so its unflushed changes are not lost
+		store.openIdxs.unreserve(key, kli)
+		return nil, err
+	}
+
+	if kli != nil {
+		kli.retired = true
+	}
+	store.openIdxs.unreserve(key, nil)
+	return result, nil
+}
+
+// storedIDs returns the entry ids of the key's stored index
+func (store *IndexStore) storedIDs(key []byte) ([][]byte, error) {
+	var ids [][]byte
+	err := store.db.View(func(tx *bolt.Tx) error {
+		ukli, _, _, err := readKeylog(tx.Bucket(store.bucket), key, 0)
+		if err != nil {
+			return err
+		}
+		return ukli.Iter(nil, func(id []byte) error {
+			ids = append(ids, id)
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func purgeEntries(tx *bolt.Tx, entries *EntryStore, ids [][]byte, result *PurgeResult) error {
+	for _, id := range ids {
+		ok, err := entries.delete(tx, id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			result.Deleted++
+		} else {
+			result.Missing++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package hexaboltdb
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+)
+
+func Test_IndexStore_PurgeKey(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := OpenDB(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entries := NewEntryStore()
+	if err = entries.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	idxs := NewIndexStore()
+	if err = idxs.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	var ids [][]byte
+	prev := make([]byte, 32)
+	for i := 0; i < 5; i++ {
+		ent := &hexalog.Entry{Previous: prev, Key: []byte("key"), Height: uint32(i + 1), LTime: uint64(i + 1)}
+		id := ent.Hash(sha256.New())
+		if err = db.CommitEntry(entries, idxs, id, ent); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		prev = id
+	}
+	// Missing entry
+	if err = entries.Delete(ids[4]); err != nil {
+		t.Fatal(err)
+	}
+
+	ki, err := idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = idxs.PurgeKey([]byte("key"), entries); err != errIndexOpen {
+		t.Fatalf("should fail with='%v' got='%v'", errIndexOpen, err)
+	}
+	ki.Close()
+
+	result, err := idxs.PurgeKey([]byte("key"), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted != 4 || result.Missing != 1 {
+		t.Fatalf("wrong purge result %+v", result)
+	}
+
+	if _, err = idxs.GetKey([]byte("key")); err != hexatype.ErrKeyNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrKeyNotFound, err)
+	}
+	if entries.Count() != 0 {
+		t.Fatal("should have 0 entries", entries.Count())
+	}
+
+	if _, err = idxs.PurgeKey([]byte("key"), entries); err != hexatype.ErrKeyNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,117 @@
+package hexaboltdb
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hexablock/hexalog"
+)
+
+var (
+	errNotShared = errors.New("stores do not share the database")
+)
+
+// CommitEntry stores the entry and appends its id to the entry key's
+// KeylogIndex in a single bolt transaction.  Either both the entry and the
+// updated index are written or neither are.  The key's index is created if it
+// does not exist.  Both stores must have been opened with this DB.
+func (db *DB) CommitEntry(entries *EntryStore, indexes *IndexStore, id []byte, entry *hexalog.Entry) error {
+	if entries.db != db || indexes.db != db {
+		return errNotShared
+	}
+
+	value, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	kli, created, err := indexes.getOrCreateKey(entry.Key)
+	if err != nil {
+		return err
+	}
+
+	err = kli.commitAppend(entries, id, value, entry)
+
+	// Do not leave behind an empty index for a key that was never committed
+	// unless another caller has acquired it in the meantime
+	if err != nil && created && indexes.openIdxs.discard(kli) {
+		indexes.openIdxs.unreserve(entry.Key, nil)
+	} else {
+		kli.Close()
+	}
+
+	return err
+}
+
+// commitAppend writes the entry along with the index as it will be after
+// appending the entry id.  The in-memory index is only updated once the
+// transaction commits.
+func (idx *KeylogIndex) commitAppend(entries *EntryStore, id, value []byte, entry *hexalog.Entry) error {
+	// Hold the flush lock so an in-flight flush cannot overwrite the index
+	// written here with an older snapshot
+	idx.fmu.Lock()
+	defer idx.fmu.Unlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := idx.checkPrev(entry.Previous); err != nil {
+		return err
+	}
+
+	// Header after the append.  Only the last id is carried over so the copy
+	// does not grow with the keylog
+	hdr := *idx.idx
+	hdr.Entries = nil
+	if last := idx.idx.Last(); last != nil {
+		hdr.Entries = [][]byte{last}
+	}
+	if err := hdr.Append(id, entry.Previous, entry.LTime); err != nil {
+		return err
+	}
+	marked := idx.marks(id)
+	if marked {
+		hdr.Marker = nil
+	}
+
+	snap, err := idx.newSnapshot(&hdr)
+	if err != nil {
+		return err
+	}
+	snap.ids = append(snap.ids, id)
+	snap.ltimes = append(snap.ltimes, entry.LTime)
+	snap.n++
+
+	err = idx.db.Update(func(tx *bolt.Tx) error {
+		if er := entries.put(tx, id, entry, value); er != nil {
+			return er
+		}
+		if marked {
+			if er := tx.Bucket(idx.mbucket).Delete(idx.Key()); er != nil {
+				return er
+			}
+			idx.db.track(tx, idx.mbucket, idx.Key())
+		}
+		// The snapshot contains all journaled mutations so the journal can be
+		// truncated as part of the same write
+		return idx.write(tx, snap)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Cannot fail as the same append succeeded on the header
+	idx.idx.Append(id, entry.Previous, entry.LTime)
+	idx.ltimes = append(idx.ltimes, entry.LTime)
+	idx.low = snap.n
+	if marked {
+		idx.clearMarker()
+	}
+	atomic.AddInt64(&idx.size, entrySize(id))
+	// Everything up to this point has been written
+	snap.written()
+
+	return nil
+}
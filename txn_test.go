@@ -0,0 +1,91 @@
+package hexaboltdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hexablock/hexalog"
+	"github.com/hexablock/hexatype"
+)
+
+func Test_DB_CommitEntry(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "hexaboltdb-")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := OpenDB(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entries := NewEntryStore()
+	if err = entries.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	idxs := NewIndexStore()
+	if err = idxs.OpenDB(db); err != nil {
+		t.Fatal(err)
+	}
+	defer idxs.Close()
+
+	ent := &hexalog.Entry{
+		Previous:  make([]byte, 32),
+		Key:       []byte("key"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		LTime:     1,
+	}
+	id := ent.Hash(sha256.New())
+	if err = db.CommitEntry(entries, idxs, id, ent); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = entries.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	ki, err := idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ki.Last(), id) {
+		t.Fatal("last id mismatch")
+	}
+	ki.Close()
+
+	// Wrong previous hash should write neither the entry nor the index
+	ent1 := &hexalog.Entry{
+		Previous:  make([]byte, 32),
+		Key:       []byte("key"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		LTime:     2,
+	}
+	id1 := ent1.Hash(sha256.New())
+	if err = db.CommitEntry(entries, idxs, id1, ent1); err != hexatype.ErrPreviousHash {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrPreviousHash, err)
+	}
+	if _, err = entries.Get(id1); err != hexatype.ErrEntryNotFound {
+		t.Fatalf("should fail with='%v' got='%v'", hexatype.ErrEntryNotFound, err)
+	}
+
+	ent1.Previous = id
+	id1 = ent1.Hash(sha256.New())
+	if err = db.CommitEntry(entries, idxs, id1, ent1); err != nil {
+		t.Fatal(err)
+	}
+	ki, err = idxs.GetKey([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ki.Count() != 2 || !bytes.Equal(ki.Last(), id1) {
+		t.Fatal("index should have both entries", ki.Count())
+	}
+	ki.Close()
+
+	other := NewEntryStore()
+	if err = db.CommitEntry(other, idxs, id1, ent1); err != errNotShared {
+		t.Fatalf("should fail with='%v' got='%v'", errNotShared, err)
+	}
+}